@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Define a custom contextKey type, with the underlying type string.
+type contextKey string
+
+// Convert the string "request_id" to a contextKey type and assign it to the
+// requestIDContextKey constant. We'll use this constant as the key for getting and
+// setting the request ID in the request context.
+const requestIDContextKey = contextKey("request_id")
+
+// The contextSetRequestID() method returns a new copy of the request with the provided
+// request ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The requestID() helper retrieves the request ID from the request context, as set by
+// the assignRequestID() middleware. It returns an empty string if there isn't one, so
+// that it's safe to call from code which might run before the middleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// The principalContextKey constant is the key for getting and setting the
+// authenticated principal in the request context.
+const principalContextKey = contextKey("principal")
+
+// The contextSetPrincipal() method returns a new copy of the request with the provided
+// principal added to the context.
+func (app *application) contextSetPrincipal(r *http.Request, p *principal) *http.Request {
+	ctx := context.WithValue(r.Context(), principalContextKey, p)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPrincipal() method retrieves the authenticated principal from the
+// request context. It returns nil if the client didn't authenticate with a TLS client
+// certificate.
+func (app *application) contextGetPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalContextKey).(*principal)
+	return p
+}
+
+// The graphqlStateContextKey constant is the key for getting and setting the state of
+// a GraphQL request (see graphqlState) in the context which is passed to the resolvers.
+const graphqlStateContextKey = contextKey("graphql_state")
+
+// The graphqlStateFrom() helper retrieves the state of the GraphQL request from the
+// context given to a resolver, as set by the graphqlHandler() method.
+func graphqlStateFrom(ctx context.Context) *graphqlState {
+	state, _ := ctx.Value(graphqlStateContextKey).(*graphqlState)
+	return state
+}
@@ -1,66 +1,424 @@
 package main
 
 import (
+	"GoFurtherWebPractice/internal/data"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// The logError() method is a generic helper for logging an error message.
+// The logError() method is a generic helper for logging an error message along with
+// the details of the request that it happened in.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.Print(err)
+	app.logger.Error(err.Error(),
+		"method", r.Method,
+		"uri", r.URL.RequestURI(),
+		"remote_addr", r.RemoteAddr,
+		"request_id", requestID(r),
+	)
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
 // messages to the client with a given status code. Note that we're using an any
 // type for the message parameter, rather than just a string type, as this gives us
 // more flexibility over the values that we can include in the response.
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
-	// Write the response using the writeJSON() helper. If this happens to return an
-	// error then log it, and fall back to sending the client an empty response with a
-	// 500 Internal Server Error status code.
-	err := app.writeJSON(w, status, env, nil)
+//
+// The request ID is included too, so that a client reporting an error can tell us which
+// request it was, and we can find the matching log entries. The code is a stable,
+// machine-readable identifier for the kind of error (see errorTitles), which is sent to
+// clients that ask for problem details responses (see writeError()).
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message any) {
+	app.writeError(w, r, status, code, message, nil, nil)
+}
+
+// Define the machine-readable codes for the errors that the API returns, along with a
+// short, human-readable summary of each one which is used as the title in problem
+// details responses. Clients can rely on these codes, so they must never be changed
+// once they have been released.
+var errorTitles = map[string]string{
+	"server_error":                "Internal server error",
+	"not_found":                   "Resource not found",
+	"method_not_allowed":          "Method not allowed",
+	"not_acceptable":              "Response format not acceptable",
+	"client_certificate_required": "Client certificate required",
+	"bad_request":                 "Malformed request",
+	"failed_validation":           "Validation failed",
+	"edit_conflict":               "Edit conflict",
+	"rate_limit_exceeded":         "Rate limit exceeded",
+	"duplicate_movie":             "Duplicate movie",
+	"idempotency_key_mismatch":    "Idempotency key reused",
+	"idempotency_key_in_flight":   "Idempotency key in use",
+	"invalid_query":               "Invalid GraphQL query",
+	"query_too_deep":              "GraphQL query too deep",
+	"query_too_complex":           "GraphQL query too complex",
+}
+
+// The writeError() method sends an error response. Clients which list
+// application/problem+json in their Accept header get an RFC 9457 problem details
+// object. Everyone else gets our original format, with the message in an "error"
+// field, rendered by the render() helper (or, in v2, the format from errorEnvelopeV2()).
+// The fields in the extra envelope are added to the response in every format.
+//
+// When the -debug-errors setting is on, server errors with debugging details in the
+// extra envelope are shown to browsers as an HTML debug page instead.
+func (app *application) writeError(w http.ResponseWriter, r *http.Request, status int, code string, message any, extra envelope, headers http.Header) {
+	var err error
+	if app.config.debugErrors && status >= 500 && extra != nil && prefersHTML(r.Header.Get("Accept")) {
+		err = app.writeDebugPage(w, r, status, code, message, extra, headers)
+	} else if acceptsProblemJSON(r.Header.Get("Accept")) {
+		err = app.writeProblem(w, r, status, code, message, extra, headers)
+	} else if apiVersion(r) == 2 {
+		err = app.render(w, r, status, errorEnvelopeV2(r, code, message, extra), headers)
+	} else {
+		env := envelope{"error": message, "request_id": requestID(r)}
+		for key, value := range extra {
+			env[key] = value
+		}
+		err = app.render(w, r, status, env, headers)
+	}
+	// If writing the response returns an error then log it, and fall back to sending
+	// the client an empty response with a 500 Internal Server Error status code.
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+// errorEnvelopeV2 returns the envelope for an error response in v2 of the API, where
+// everything about the error is in an "error" object: the code, a message, the request
+// ID and the fields in the extra envelope. For failed validation, where the message is
+// the map of errors from a Validator, the map is sent as "details" instead.
+func errorEnvelopeV2(r *http.Request, code string, message any, extra envelope) envelope {
+	body := envelope{"code": code, "request_id": requestID(r)}
+	switch message := message.(type) {
+	case map[string]string:
+		body["message"] = "the request contains one or more invalid values"
+		body["details"] = message
+	default:
+		body["message"] = fmt.Sprint(message)
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+	return envelope{"error": body}
+}
+
+// The writeProblem() method sends an error as an RFC 9457 problem details object. The
+// type is a URI reference made from the error code, and the code itself and the request
+// ID are included as extension members. For failed validation, where the message is
+// the map of errors from a Validator, each error is listed in an "errors" array. These
+// identify the invalid value with a "parameter" member if it came from the query string,
+// and otherwise with a "pointer" member containing a JSON pointer into the request body.
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, message any, extra envelope, headers http.Header) error {
+	title, ok := errorTitles[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+
+	problem := envelope{
+		"type":       "/problems/" + code,
+		"title":      title,
+		"status":     status,
+		"instance":   r.URL.RequestURI(),
+		"code":       code,
+		"request_id": requestID(r),
+	}
+
+	switch message := message.(type) {
+	case map[string]string:
+		problem["detail"] = "the request contains one or more invalid values"
+
+		keys := make([]string, 0, len(message))
+		for key := range message {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		errs := make([]envelope, len(keys))
+		for i, key := range keys {
+			if r.URL.Query().Has(key) {
+				errs[i] = envelope{"parameter": key, "detail": message[key]}
+			} else {
+				errs[i] = envelope{"pointer": jsonPointer(key), "detail": message[key]}
+			}
+		}
+		problem["errors"] = errs
+	default:
+		problem["detail"] = fmt.Sprint(message)
+	}
+
+	for key, value := range extra {
+		problem[key] = value
+	}
+
+	js, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+	body, err := encodeJSON(js, app.pretty(r))
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// The acceptsProblemJSON() function reports whether the value of an Accept header
+// explicitly lists application/problem+json (with a non-zero quality value). Wildcards
+// don't count, so that clients only get problem details if they've asked for them.
+func acceptsProblemJSON(header string) bool {
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "application/problem+json") {
+			continue
+		}
+		for _, param := range params[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.TrimSpace(name) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// jsonPointer returns a JSON pointer (in its URI fragment form, as used in the RFC 9457
+// examples) to the top-level field with the given name.
+func jsonPointer(field string) string {
+	escaped := strings.NewReplacer("~", "~0", "/", "~1").Replace(field)
+	return "#/" + (&url.URL{Fragment: escaped}).EscapedFragment()
+}
+
 // The serverErrorResponse() method will be used when our application encounters an
 // unexpected problem at runtime. It logs the detailed error message, then uses the
 // errorResponse() helper to send a 500 Internal Server Error status code and JSON
-// response (containing a generic error message) to the client.
+// response (containing a generic error message) to the client. If the -debug-errors
+// setting is on (as it is in development), the error and the stack trace are included
+// in the response too.
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	if !app.config.debugErrors {
+		app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
+		return
+	}
+
+	extra := envelope{"cause": err.Error(), "stack": string(debug.Stack())}
+	app.writeError(w, r, http.StatusInternalServerError, "server_error", message, extra, nil)
+}
+
+// The panicResponse() method is used by the recoverPanic() middleware. It logs the
+// panic value and stack trace along with the request method, path and ID, then sends
+// the same generic response as serverErrorResponse(). If the -debug-errors setting is
+// on, the stack trace is included in the response body too, to make debugging easier.
+func (app *application) panicResponse(w http.ResponseWriter, r *http.Request, err error, stack []byte) {
+	app.logger.Error("panic: "+err.Error(),
+		"method", r.Method,
+		"uri", r.URL.RequestURI(),
+		"remote_addr", r.RemoteAddr,
+		"request_id", requestID(r),
+		"stack", string(stack),
+	)
+
+	message := "the server encountered a problem and could not process your request"
+	if !app.config.debugErrors {
+		app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
+		return
+	}
+
+	extra := envelope{"panic": err.Error(), "stack": string(stack)}
+	app.writeError(w, r, http.StatusInternalServerError, "server_error", message, extra, nil)
 }
 
 // The notFoundResponse() method will be used to send a 404 Not Found status code and
 // JSON response to the client.
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 // The methodNotAllowedResponse() method will be used to send a 405 Method Not Allowed
 // status code and JSON response to the client.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
+}
+
+// The notAcceptableResponse() method will be used to send a 406 Not Acceptable status
+// code and JSON response to the client, when it doesn't accept any of the formats that
+// the response can be rendered in.
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource is not available in a format listed in the Accept header (supported formats are application/json, application/xml, application/msgpack, and text/csv for lists)"
+	app.errorResponse(w, r, http.StatusNotAcceptable, "not_acceptable", message)
+}
+
+func (app *application) clientCertificateRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can only be changed by clients which authenticate with a TLS client certificate"
+	app.errorResponse(w, r, http.StatusForbidden, "client_certificate_required", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
 // Note that the errors parameter here has the type map[string]string, which is exactly
 // the same as the errors map contained in our Validator type.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", message)
+}
+
+// The duplicateMovieResponse() method sends a 409 Conflict status code and JSON response
+// listing the existing movies which the client may be trying to create again. Each of
+// the likely duplicates is also linked to from the Link header.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, duplicates []*data.Duplicate) {
+	type duplicateLink struct {
+		ID         int64   `json:"id"`
+		Title      string  `json:"title"`
+		Year       int32   `json:"year"`
+		Similarity float64 `json:"similarity"`
+		Exact      bool    `json:"exact"`
+		URL        string  `json:"url"`
+	}
+
+	headers := make(http.Header)
+	links := make([]duplicateLink, len(duplicates))
+	for i, duplicate := range duplicates {
+		url := moviePath(r, duplicate.Movie.ID)
+		links[i] = duplicateLink{
+			ID:         duplicate.Movie.ID,
+			Title:      duplicate.Movie.Title,
+			Year:       duplicate.Movie.Year,
+			Similarity: duplicate.Similarity,
+			Exact:      duplicate.Exact,
+			URL:        url,
+		}
+		headers.Add("Link", fmt.Sprintf(`<%s>; rel="duplicate"`, url))
+	}
+
+	message := "a movie with the same or a similar title already exists, set force=true to create it anyway"
+	app.writeError(w, r, http.StatusConflict, "duplicate_movie", message, envelope{"duplicates": links}, headers)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key header has already been used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "idempotency_key_mismatch", message)
+}
+
+func (app *application) idempotencyKeyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with the same Idempotency-Key header is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, "idempotency_key_in_flight", message)
+}
+
+// prefersHTML reports whether the client is (most likely) a web browser, which we take
+// to be the case if text/html is the first media type in its Accept header.
+func prefersHTML(accept string) bool {
+	first, _, _ := strings.Cut(accept, ",")
+	first, _, _ = strings.Cut(first, ";")
+	return strings.EqualFold(strings.TrimSpace(first), "text/html")
+}
+
+// debugPage is the template for the debug error page (see writeDebugPage()).
+var debugPage = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+th { text-align: left; padding-right: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Message}}</p>
+<table>
+<tr><th>Request</th><td>{{.Method}} {{.URI}}</td></tr>
+<tr><th>Request ID</th><td>{{.RequestID}}</td></tr>
+<tr><th>Error code</th><td>{{.Code}}</td></tr>
+</table>
+{{range .Details}}
+<h2>{{.Name}}</h2>
+<pre>{{.Value}}</pre>
+{{end}}
+<p><small>This page is only shown when the -debug-errors setting is on.</small></p>
+</body>
+</html>
+`))
+
+// The writeDebugPage() method sends an error as an HTML page for browsers, listing the
+// details of the request and each of the fields in the extra envelope (like the panic
+// value and stack trace). It's only used when the -debug-errors setting is on.
+func (app *application) writeDebugPage(w http.ResponseWriter, r *http.Request, status int, code string, message any, extra envelope, headers http.Header) error {
+	type detail struct {
+		Name  string
+		Value string
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	details := make([]detail, len(names))
+	for i, name := range names {
+		details[i] = detail{Name: name, Value: fmt.Sprint(extra[name])}
+	}
+
+	title, ok := errorTitles[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+
+	var buf bytes.Buffer
+	err := debugPage.Execute(&buf, map[string]any{
+		"Status":    status,
+		"Title":     title,
+		"Message":   message,
+		"Method":    r.Method,
+		"URI":       r.URL.RequestURI(),
+		"RequestID": requestID(r),
+		"Code":      code,
+		"Details":   details,
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+	return nil
 }
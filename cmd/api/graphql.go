@@ -0,0 +1,531 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"GoFurtherWebPractice/internal/validator"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// The graphqlHandler() method returns the handler for POST /v1/graphql, which runs a
+// GraphQL query or mutation against the schema from graphqlSchema(). The request body is
+// a JSON object with the query and, optionally, the operation name and variables, as
+// described by the GraphQL over HTTP specification.
+//
+// Before a query is run, it's parsed and validated against the schema, and checked
+// against the -graphql-max-depth and -graphql-max-complexity limits. Problems at this
+// stage mean that the query can't be run at all, so they're sent with a 400 Bad Request
+// status code (or 403 Forbidden for a mutation from a client without a required TLS
+// client certificate). Once a query has been run, the response always has a 200 OK status code,
+// with any errors from the resolvers listed alongside the data.
+func (app *application) graphqlHandler() http.HandlerFunc {
+	// A schema which can't be built is a programming error, so we panic, in the same
+	// way as routes() does for a mismatch with the OpenAPI document.
+	schema, err := app.graphqlSchema()
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL schema: %s", err))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Query         string         `json:"query"`
+			OperationName string         `json:"operationName"`
+			Variables     map[string]any `json:"variables"`
+			Extensions    map[string]any `json:"extensions"`
+		}
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		v := validator.New()
+		if v.Check(strings.TrimSpace(input.Query) != "", "query", "must be provided"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		doc, err := parser.Parse(parser.ParseParams{
+			Source: source.NewSource(&source.Source{Body: []byte(input.Query), Name: "GraphQL request"}),
+		})
+		if err != nil {
+			app.graphqlResponse(w, r, http.StatusBadRequest, nil, invalidQuery(gqlerrors.FormatErrors(err)))
+			return
+		}
+		result := graphql.ValidateDocument(&schema, doc, nil)
+		if !result.IsValid {
+			app.graphqlResponse(w, r, http.StatusBadRequest, nil, invalidQuery(result.Errors))
+			return
+		}
+
+		// Mutations change movies, so like the REST routes which do, they require a TLS
+		// client certificate when those are enabled (see requirePrincipal()).
+		if operation := graphqlOperation(doc, input.OperationName); operation != nil && operation.Operation == ast.OperationTypeMutation && !app.hasRequiredPrincipal(r) {
+			err := &graphqlError{code: "client_certificate_required", message: "mutations can only be run by clients which authenticate with a TLS client certificate"}
+			app.graphqlResponse(w, r, http.StatusForbidden, nil, gqlerrors.FormatErrors(err))
+			return
+		}
+
+		cost := graphqlCost{schema: &schema, variables: input.Variables, fragments: make(map[string]*ast.FragmentDefinition)}
+		depth, complexity := cost.document(doc, input.OperationName)
+		if depth > app.config.graphql.maxDepth {
+			err := &graphqlError{code: "query_too_deep", message: fmt.Sprintf("the query is nested %d levels deep, which is more than the limit of %d", depth, app.config.graphql.maxDepth)}
+			app.graphqlResponse(w, r, http.StatusBadRequest, nil, gqlerrors.FormatErrors(err))
+			return
+		}
+		if complexity > app.config.graphql.maxComplexity {
+			err := &graphqlError{code: "query_too_complex", message: fmt.Sprintf("the query has an estimated complexity of %d, which is more than the limit of %d", complexity, app.config.graphql.maxComplexity)}
+			app.graphqlResponse(w, r, http.StatusBadRequest, nil, gqlerrors.FormatErrors(err))
+			return
+		}
+
+		// Each request gets its own state, holding the request itself (so that the
+		// resolvers can tag their queries with the request ID, and log errors against
+		// it) and the batch loaders for the sub-resources.
+		state := app.newGraphQLState(r)
+		ctx := context.WithValue(r.Context(), graphqlStateContextKey, state)
+
+		executed := graphql.Execute(graphql.ExecuteParams{
+			Schema:        schema,
+			AST:           doc,
+			OperationName: input.OperationName,
+			Args:          input.Variables,
+			Context:       ctx,
+		})
+		// If there's no data at all, and the errors aren't about any field, the
+		// operation couldn't be run (for example, because the variables had the wrong
+		// types), which is a bad request too.
+		if executed.Data == nil && !slices.ContainsFunc(executed.Errors, func(e gqlerrors.FormattedError) bool { return len(e.Path) > 0 }) {
+			app.graphqlResponse(w, r, http.StatusBadRequest, nil, invalidQuery(executed.Errors))
+			return
+		}
+
+		// Otherwise, any errors which didn't come from our resolvers (like a panic in
+		// a resolver, which the graphql package recovers from, or a null value for a
+		// non-null field) are bugs on our side, so we log them, and send the generic
+		// server error in their place.
+		for i, formatted := range executed.Errors {
+			if graphqlExtensions(formatted) == nil {
+				gqlErr := app.graphqlServerError(r, formatted).(*graphqlError)
+				executed.Errors[i].Message = gqlErr.message
+				executed.Errors[i].Extensions = gqlErr.Extensions()
+			}
+		}
+		app.graphqlResponse(w, r, http.StatusOK, executed.Data, executed.Errors)
+	}
+}
+
+// The graphqlResponse() method sends a GraphQL response, with the data (if the operation
+// was run) and any errors. The request ID is included in the response's extensions, in
+// the same way as it's included in our other error responses.
+func (app *application) graphqlResponse(w http.ResponseWriter, r *http.Request, status int, result any, errs []gqlerrors.FormattedError) {
+	env := envelope{"extensions": envelope{"request_id": requestID(r)}}
+	if result != nil {
+		env["data"] = result
+	}
+	if len(errs) > 0 {
+		for i := range errs {
+			errs[i].Extensions = graphqlExtensions(errs[i])
+		}
+		env["errors"] = errs
+	}
+
+	err := app.render(w, r, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The graphqlError type is an error returned by a resolver, which is sent to the client
+// with the same machine-readable codes as our other error responses (see errorTitles)
+// in its extensions. The extra fields, like the validation errors, are sent in the
+// extensions too.
+type graphqlError struct {
+	code    string
+	message string
+	extra   map[string]any
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]any {
+	extensions := map[string]any{"code": e.code}
+	for key, value := range e.extra {
+		extensions[key] = value
+	}
+	return extensions
+}
+
+// graphqlExtensions returns the extensions for an error in a GraphQL response. The
+// graphql package only looks for the extensions of errors returned by resolvers
+// directly, so we look for a graphqlError inside the errors it has wrapped, to find
+// those returned from the thunks that batched fields resolve to as well.
+func graphqlExtensions(formatted gqlerrors.FormattedError) map[string]any {
+	var err error = formatted
+	for err != nil {
+		switch e := err.(type) {
+		case *graphqlError:
+			return e.Extensions()
+		case gqlerrors.FormattedError:
+			if e.Extensions != nil {
+				return e.Extensions
+			}
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			err = nil
+		}
+	}
+	return nil
+}
+
+// invalidQuery gives the errors from parsing and validating a query the invalid_query
+// code, so that every error in a response has a code.
+func invalidQuery(errs []gqlerrors.FormattedError) []gqlerrors.FormattedError {
+	for i := range errs {
+		if errs[i].Extensions == nil {
+			errs[i].Extensions = map[string]any{"code": "invalid_query"}
+		}
+	}
+	return errs
+}
+
+// The graphqlServerError() method logs an unexpected error from a resolver, and returns
+// the generic error which is sent to the client in its place. As in
+// serverErrorResponse(), the error itself is included when -debug-errors is on.
+func (app *application) graphqlServerError(r *http.Request, err error) error {
+	app.logError(r, err)
+	gqlErr := &graphqlError{code: "server_error", message: "the server encountered a problem and could not process your request"}
+	if app.config.debugErrors {
+		gqlErr.extra = map[string]any{"cause": err.Error()}
+	}
+	return gqlErr
+}
+
+// graphqlValidationError returns the error for a resolver whose arguments failed
+// validation, with the errors from the Validator in its extensions.
+func graphqlValidationError(errs map[string]string) error {
+	return &graphqlError{code: "failed_validation", message: "the request contains one or more invalid values", extra: map[string]any{"details": errs}}
+}
+
+// The graphqlState type holds the state of a single GraphQL request: the HTTP request,
+// and the batch loaders which collect the sub-resources that the resolvers ask for, so
+// that they can be loaded with one query for each level of the response rather than
+// one query for each movie or genre.
+type graphqlState struct {
+	r           *http.Request
+	similar     *batchLoader[int64, []*data.Movie]
+	genreMovies *batchLoader[genreMoviesKey, []*data.Movie]
+}
+
+// genreMoviesKey identifies a list of movies with a genre, as loaded for the
+// Genre.movies field: the genre, and the number of movies asked for.
+type genreMoviesKey struct {
+	genre string
+	limit int
+}
+
+func (app *application) newGraphQLState(r *http.Request) *graphqlState {
+	return &graphqlState{
+		r: r,
+		similar: newBatchLoader(func(ids []int64) (map[int64][]*data.Movie, error) {
+			// A query can ask for the similar movies of every movie in a page, so
+			// fewer candidates are scored for each one than for a single movie
+			// in GET /v1/movies/:id/similar.
+			limit := min(app.config.similar.maxCandidates, app.config.graphql.similarCandidates)
+			return app.movies(r).GetSimilarCandidatesForMany(ids, limit)
+		}),
+		genreMovies: newBatchLoader(func(keys []genreMoviesKey) (map[genreMoviesKey][]*data.Movie, error) {
+			// The genres are fetched with one query for each distinct limit, which
+			// is normally just one, as the same field is asked for every genre.
+			genres := make(map[int][]string)
+			for _, key := range keys {
+				genres[key.limit] = append(genres[key.limit], key.genre)
+			}
+			movies := make(map[genreMoviesKey][]*data.Movie, len(keys))
+			for limit, names := range genres {
+				byGenre, err := app.movies(r).GetForGenres(names, limit)
+				if err != nil {
+					return nil, err
+				}
+				for genre, list := range byGenre {
+					movies[genreMoviesKey{genre, limit}] = list
+				}
+			}
+			return movies, nil
+		}),
+	}
+}
+
+// The batchLoader type collects the keys which resolvers ask for, and loads all of the
+// ones that are still pending with a single call to the fetch function when the first
+// of their values is needed. It relies on how the graphql package runs resolvers which
+// return a thunk (a func() (any, error)): it resolves every field at one level of the
+// response before calling any of the thunks, so by the time that the first thunk at a
+// level is called, the keys for all of the others have been collected.
+//
+// The graphql package resolves fields on a single goroutine, so there's no locking.
+type batchLoader[K comparable, V any] struct {
+	fetch   func(keys []K) (map[K]V, error)
+	pending []K
+	queued  map[K]bool
+	results map[K]V
+	errs    map[K]error
+}
+
+func newBatchLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{
+		fetch:   fetch,
+		queued:  make(map[K]bool),
+		results: make(map[K]V),
+		errs:    make(map[K]error),
+	}
+}
+
+// The load() method adds a key to the next batch (unless it's already been loaded or
+// queued), and returns a function which returns its value, loading the batch first if
+// it hasn't been loaded yet.
+func (l *batchLoader[K, V]) load(key K) func() (V, error) {
+	if !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+
+	return func() (V, error) {
+		_, loaded := l.results[key]
+		_, failed := l.errs[key]
+		if !loaded && !failed {
+			l.flush()
+		}
+		return l.results[key], l.errs[key]
+	}
+}
+
+// The flush() method loads every pending key with a single call to the fetch function.
+// If it fails, the error is recorded against each of the keys.
+func (l *batchLoader[K, V]) flush() {
+	keys := l.pending
+	l.pending = nil
+	values, err := l.fetch(keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errs[key] = err
+		} else {
+			l.results[key] = values[key]
+		}
+	}
+}
+
+// graphqlDefaultListSize is the number of items that a list field without a size
+// argument (like Query.genres) is assumed to return, when estimating the complexity of
+// a query.
+const graphqlDefaultListSize = 10
+
+// The graphqlCost type works out the depth and estimated complexity of a GraphQL query,
+// so that queries which would be too expensive to run can be turned away up front. The
+// depth is the number of levels of nested fields. The complexity is an estimate of the
+// number of fields in the response: each field counts as one, and the fields inside a
+// list are multiplied by the number of items that it can return. That's the value of
+// the list's first argument, or for a list inside a page (like MoviePage.items), the
+// pageSize argument of the field which returned the page (in either case, taking the
+// value of a variable, or the default for the variable or the argument, if it isn't
+// given directly). Other lists count as graphqlDefaultListSize items. The
+// introspection fields (like __schema) don't count, as the size of their response is
+// bounded by the schema.
+type graphqlCost struct {
+	schema    *graphql.Schema
+	variables map[string]any
+	fragments map[string]*ast.FragmentDefinition
+}
+
+// The document() method returns the depth and complexity of the operation with the
+// given name (or the only operation, if the name is empty). The document must already
+// have been validated, which guarantees that the fragments don't form a cycle.
+func (c *graphqlCost) document(doc *ast.Document, operationName string) (int, int) {
+	for _, definition := range doc.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			c.fragments[fragment.Name.Value] = fragment
+		}
+	}
+	operation := graphqlOperation(doc, operationName)
+	if operation == nil {
+		return 0, 0
+	}
+
+	// Variables which weren't given take the default from their definition in the
+	// operation, if there is one.
+	variables := make(map[string]any, len(c.variables))
+	for _, definition := range operation.VariableDefinitions {
+		if definition.DefaultValue != nil {
+			variables[definition.Variable.Name.Value] = graphqlValue(definition.DefaultValue)
+		}
+	}
+	for name, value := range c.variables {
+		if value != nil {
+			variables[name] = value
+		}
+	}
+	c.variables = variables
+
+	root := c.schema.QueryType()
+	if operation.Operation == ast.OperationTypeMutation {
+		root = c.schema.MutationType()
+	}
+	return c.selectionSet(root, operation.SelectionSet, 0)
+}
+
+// graphqlOperation returns the operation in the document which is to be run: the one
+// with the given name or, if no name is given, the only one. It returns nil if there's
+// no such operation, which ValidateDocument() and Execute() report.
+func graphqlOperation(doc *ast.Document, operationName string) *ast.OperationDefinition {
+	var operation *ast.OperationDefinition
+	for _, definition := range doc.Definitions {
+		if definition, ok := definition.(*ast.OperationDefinition); ok {
+			if operationName == "" || (definition.Name != nil && definition.Name.Value == operationName) {
+				operation = definition
+			}
+		}
+	}
+	return operation
+}
+
+// The selectionSet() method returns the depth and complexity of a selection set on the
+// parent type. The pageSize is the size of the page that the parent is, if it was
+// returned by a field with a pageSize argument, or 0 otherwise.
+func (c *graphqlCost) selectionSet(parent *graphql.Object, set *ast.SelectionSet, pageSize int) (int, int) {
+	if parent == nil || set == nil {
+		return 0, 0
+	}
+	depth, complexity := 0, 0
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			name := selection.Name.Value
+			field, ok := parent.Fields()[name]
+			if strings.HasPrefix(name, "__") || !ok {
+				continue
+			}
+
+			// A field returning a list multiplies the complexity of its selection by
+			// the number of items, while a field returning a page passes its size on
+			// to the list inside it.
+			items, childPageSize := 1, 0
+			switch {
+			case !isGraphQLList(field.Type):
+				childPageSize = c.argument(field, selection, "pageSize")
+			case c.argument(field, selection, "first") > 0:
+				items = c.argument(field, selection, "first")
+			case pageSize > 0:
+				items = pageSize
+			default:
+				items = graphqlDefaultListSize
+			}
+
+			child, _ := graphql.GetNamed(field.Type).(*graphql.Object)
+			childDepth, childComplexity := c.selectionSet(child, selection.SelectionSet, childPageSize)
+			depth = max(depth, childDepth+1)
+			complexity = saturatingAdd(complexity, saturatingAdd(1, saturatingMul(items, childComplexity)))
+		case *ast.InlineFragment:
+			target := parent
+			if selection.TypeCondition != nil {
+				target, _ = c.schema.Type(selection.TypeCondition.Name.Value).(*graphql.Object)
+			}
+			fragmentDepth, fragmentComplexity := c.selectionSet(target, selection.SelectionSet, pageSize)
+			depth = max(depth, fragmentDepth)
+			complexity = saturatingAdd(complexity, fragmentComplexity)
+		case *ast.FragmentSpread:
+			fragment, ok := c.fragments[selection.Name.Value]
+			if !ok {
+				continue
+			}
+			target, _ := c.schema.Type(fragment.TypeCondition.Name.Value).(*graphql.Object)
+			fragmentDepth, fragmentComplexity := c.selectionSet(target, fragment.SelectionSet, pageSize)
+			depth = max(depth, fragmentDepth)
+			complexity = saturatingAdd(complexity, fragmentComplexity)
+		}
+	}
+	return depth, complexity
+}
+
+// The argument() method returns the value of a size argument (first or pageSize) of a
+// field in the query: the value given directly or in a variable, or else the
+// argument's default. It returns 0 if the field has no such argument, and at least 1
+// otherwise.
+func (c *graphqlCost) argument(field *graphql.FieldDefinition, selection *ast.Field, name string) int {
+	for _, arg := range field.Args {
+		if arg.Name() != name {
+			continue
+		}
+		size := 0
+		if n, ok := arg.DefaultValue.(int); ok {
+			size = n
+		}
+		for _, given := range selection.Arguments {
+			if given.Name.Value != name {
+				continue
+			}
+			value := graphqlValue(given.Value)
+			if variable, ok := given.Value.(*ast.Variable); ok {
+				value = c.variables[variable.Name.Value]
+			}
+			switch n := value.(type) {
+			case int:
+				size = n
+			case float64:
+				size = int(min(n, math.MaxInt32))
+			}
+		}
+		return max(size, 1)
+	}
+	return 0
+}
+
+// graphqlValue returns the value of an integer literal in a query, or nil for anything
+// else (including variables, which the caller looks up).
+func graphqlValue(value ast.Value) any {
+	if value, ok := value.(*ast.IntValue); ok {
+		n, err := strconv.Atoi(value.Value)
+		if err != nil {
+			return math.MaxInt32
+		}
+		return n
+	}
+	return nil
+}
+
+// isGraphQLList reports whether a field type is a list (or a non-null list).
+func isGraphQLList(typ graphql.Type) bool {
+	if nonNull, ok := typ.(*graphql.NonNull); ok {
+		typ = nonNull.OfType
+	}
+	_, ok := typ.(*graphql.List)
+	return ok
+}
+
+// saturatingAdd and saturatingMul add and multiply non-negative numbers, stopping at
+// math.MaxInt32 instead of overflowing, so that a query with enormous list sizes can't
+// wrap around to a small complexity.
+func saturatingAdd(a, b int) int {
+	return min(a+b, math.MaxInt32)
+}
+
+func saturatingMul(a, b int) int {
+	if a != 0 && b > math.MaxInt32/a {
+		return math.MaxInt32
+	}
+	return min(a*b, math.MaxInt32)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+func TestGraphQLCost(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		operationName  string
+		variables      map[string]any
+		wantDepth      int
+		wantComplexity int
+	}{
+		{
+			// The items of a page count as the page's default size (20), not as the
+			// default list size on top of it.
+			name:           "page default size",
+			query:          `{ movies { items { id title year runtime genres } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 20*5,
+		},
+		{
+			name:           "page size argument",
+			query:          `{ movies(pageSize: 100) { items { id title } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 100*2,
+		},
+		{
+			name:           "page size variable",
+			query:          `query($n: Int) { movies(pageSize: $n) { items { id } } }`,
+			variables:      map[string]any{"n": float64(3)},
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 3*1,
+		},
+		{
+			name:           "page size variable default",
+			query:          `query($n: Int = 100) { movies(pageSize: $n) { items { id } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 100*1,
+		},
+		{
+			name:           "page size variable overrides default",
+			query:          `query($n: Int = 100) { movies(pageSize: $n) { items { id } } }`,
+			variables:      map[string]any{"n": float64(2)},
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 2*1,
+		},
+		{
+			name:           "page size variable without value or default",
+			query:          `query($n: Int) { movies(pageSize: $n) { items { id } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 20*1,
+		},
+		{
+			// The metadata is a single object, so it isn't multiplied by the page size.
+			name:           "page metadata",
+			query:          `{ movies(pageSize: 50) { metadata { pageSize totalRecords } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 2,
+		},
+		{
+			name:           "first argument",
+			query:          `{ movie(id: "1") { similar(first: 2) { score movie { id } } } }`,
+			wantDepth:      4,
+			wantComplexity: 1 + 1 + 2*(1+1+1),
+		},
+		{
+			name:           "nested lists",
+			query:          `{ genres { name movies { id } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + graphqlDefaultListSize*(1+1+10*1),
+		},
+		{
+			name:           "fragments",
+			query:          `{ movies(pageSize: 4) { ...page } } fragment page on MoviePage { items { ... on Movie { id title } } }`,
+			wantDepth:      3,
+			wantComplexity: 1 + 1 + 4*2,
+		},
+		{
+			name:           "introspection",
+			query:          `{ __schema { types { name fields { name } } } }`,
+			wantDepth:      0,
+			wantComplexity: 0,
+		},
+		{
+			name:           "mutation",
+			query:          `mutation { deleteMovie(id: "1") }`,
+			wantDepth:      1,
+			wantComplexity: 1,
+		},
+		{
+			name:           "named operation",
+			query:          `query small { movie(id: "1") { id } } query large { movies(pageSize: 100) { items { id } } }`,
+			operationName:  "small",
+			wantDepth:      2,
+			wantComplexity: 2,
+		},
+	}
+
+	app, _ := newTestApplication(t)
+	schema, err := app.graphqlSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(tt.query)})})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cost := graphqlCost{schema: &schema, variables: tt.variables, fragments: make(map[string]*ast.FragmentDefinition)}
+			depth, complexity := cost.document(doc, tt.operationName)
+			if depth != tt.wantDepth {
+				t.Errorf("got depth %d; want %d", depth, tt.wantDepth)
+			}
+			if complexity != tt.wantComplexity {
+				t.Errorf("got complexity %d; want %d", complexity, tt.wantComplexity)
+			}
+		})
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantCode string
+	}{
+		{"too deep", `{ movie(id: "1") { similar { movie { similar { movie { id } } } } } }`, "query_too_deep"},
+		{"too complex", `{ movies(pageSize: 100) { items { id title year runtime genres version } } }`, "query_too_complex"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newTestApplication(t)
+			app.config.graphql.maxDepth = 4
+			app.config.graphql.maxComplexity = 500
+
+			headers := http.Header{"Content-Type": []string{"application/json"}}
+			res := send(t, app.routes(), http.MethodPost, "/v1/graphql", graphqlBody(tt.query, nil), headers)
+			if res.status != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d; body: %s", res.status, http.StatusBadRequest, res.body)
+			}
+			var body struct {
+				Errors []struct {
+					Extensions struct {
+						Code string `json:"code"`
+					} `json:"extensions"`
+				} `json:"errors"`
+			}
+			err := json.Unmarshal(res.body, &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Errors) != 1 || body.Errors[0].Extensions.Code != tt.wantCode {
+				t.Errorf("got body %s; want an error with code %s", res.body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBatchLoader(t *testing.T) {
+	var batches [][]int
+	loader := newBatchLoader(func(keys []int) (map[int]string, error) {
+		batches = append(batches, slices.Clone(keys))
+		values := make(map[int]string, len(keys))
+		for _, key := range keys {
+			values[key] = strings.Repeat("x", key)
+		}
+		return values, nil
+	})
+
+	// Every key which is queued before the first value is needed is loaded in one
+	// batch, and a key which is asked for twice is only loaded once.
+	thunks := []func() (string, error){loader.load(1), loader.load(2), loader.load(1), loader.load(3)}
+	for i, key := range []int{1, 2, 1, 3} {
+		value, err := thunks[i]()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != strings.Repeat("x", key) {
+			t.Errorf("got %q for key %d; want %q", value, key, strings.Repeat("x", key))
+		}
+	}
+
+	// Keys which have already been loaded come from the cache, and only the new keys
+	// go in the next batch.
+	cached, fresh := loader.load(2), loader.load(4)
+	if value, _ := cached(); value != "xx" {
+		t.Errorf("got %q for key 2; want %q", value, "xx")
+	}
+	if value, _ := fresh(); value != "xxxx" {
+		t.Errorf("got %q for key 4; want %q", value, "xxxx")
+	}
+
+	want := [][]int{{1, 2, 3}, {4}}
+	if !slices.EqualFunc(batches, want, slices.Equal[[]int]) {
+		t.Errorf("got batches %v; want %v", batches, want)
+	}
+}
+
+func TestBatchLoaderError(t *testing.T) {
+	fetchErr := errors.New("fetch failed")
+	calls := 0
+	loader := newBatchLoader(func(keys []string) (map[string]int, error) {
+		calls++
+		return nil, fetchErr
+	})
+
+	// A failed fetch is reported for every key in the batch, without being retried.
+	thunks := []func() (int, error){loader.load("a"), loader.load("b")}
+	for _, thunk := range thunks {
+		if _, err := thunk(); !errors.Is(err, fetchErr) {
+			t.Errorf("got error %v; want %v", err, fetchErr)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls to fetch; want 1", calls)
+	}
+}
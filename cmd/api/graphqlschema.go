@@ -0,0 +1,523 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"GoFurtherWebPractice/internal/recommender"
+	"GoFurtherWebPractice/internal/validator"
+	"errors"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+)
+
+// The graphqlSchema() method builds the schema for the GraphQL endpoint. It exposes the
+// same movie catalogue as the REST endpoints, backed by the same models and validation:
+//
+//   - The movie, movies and genres queries read movies by ID, a page of a filtered and
+//     sorted listing (checked with data.ValidateFilters()), and the genres in use.
+//   - The createMovie, updateMovie and deleteMovie mutations change movies, checking
+//     them with data.ValidateMovie() first, as the REST handlers do.
+//
+// Movies are represented in the same way as in v2 of the REST API: the runtime is an
+// integer number of minutes, and the timestamps are RFC 3339 times. The Movie.similar
+// and Genre.movies fields are resolved with batch loaders (see graphqlState), so that a
+// list of movies or genres needs one query for the sub-resources, rather than one for
+// each item in the list.
+func (app *application) graphqlSchema() (graphql.Schema, error) {
+	var movieType *graphql.Object
+
+	similarMovieType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "SimilarMovie",
+		Description: "A movie which is similar to another one, with its similarity score.",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"score": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.Float),
+					Description: "How similar the movie is, from 0 to 1.",
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return p.Source.(recommender.Result).Score, nil
+					},
+				},
+				"movie": &graphql.Field{
+					Type: graphql.NewNonNull(movieType),
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return p.Source.(recommender.Result).Movie, nil
+					},
+				},
+			}
+		}),
+	})
+
+	movieType = graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Movie",
+		Description: "A movie in the catalogue.",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return strconv.FormatInt(p.Source.(*data.Movie).ID, 10), nil
+				},
+			},
+			"title": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).Title, nil
+				},
+			},
+			"year": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "The year the movie was released.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).Year, nil
+				},
+			},
+			"runtime": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "The runtime in minutes.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return int32(p.Source.(*data.Movie).Runtime), nil
+				},
+			},
+			"genres": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).Genres, nil
+				},
+			},
+			"version": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "Starts at 1 and is incremented each time the movie is changed.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).Version, nil
+				},
+			},
+			"createdAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.DateTime),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).CreatedAt.UTC(), nil
+				},
+			},
+			"updatedAt": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.DateTime),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Movie).UpdatedAt.UTC(), nil
+				},
+			},
+			"similar": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(similarMovieType))),
+				Description: "The movies most similar to this one, most similar first, chosen from the movies which share the most genres with it.",
+				Args: graphql.FieldConfigArgument{
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 5, Description: "The number of movies to return (at most 100)."},
+				},
+				Resolve: app.resolveSimilarMovies,
+			},
+		},
+	})
+
+	genreType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Genre",
+		Description: "A genre which at least one movie has.",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Genre).Name, nil
+				},
+			},
+			"movieCount": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "The number of movies with the genre.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*data.Genre).Movies, nil
+				},
+			},
+			"movies": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(movieType))),
+				Description: "The first movies with the genre, by ID.",
+				Args: graphql.FieldConfigArgument{
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10, Description: "The number of movies to return (at most 100)."},
+				},
+				Resolve: app.resolveGenreMovies,
+			},
+		},
+	})
+
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "PageMetadata",
+		Description: "Where a page of movies is in the full listing. Every field is 0 when there are no matching movies.",
+		Fields: graphql.Fields{
+			"currentPage":  metadataField(func(m data.Metadata) int { return m.CurrentPage }),
+			"pageSize":     metadataField(func(m data.Metadata) int { return m.PageSize }),
+			"firstPage":    metadataField(func(m data.Metadata) int { return m.FirstPage }),
+			"lastPage":     metadataField(func(m data.Metadata) int { return m.LastPage }),
+			"totalRecords": metadataField(func(m data.Metadata) int { return m.TotalRecords }),
+		},
+	})
+
+	moviePageType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "MoviePage",
+		Description: "A page of movies.",
+		Fields: graphql.Fields{
+			"items": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(movieType))),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(moviePage).movies, nil
+				},
+			},
+			"metadata": &graphql.Field{
+				Type: graphql.NewNonNull(metadataType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(moviePage).metadata, nil
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"movie": &graphql.Field{
+				Type:        movieType,
+				Description: "The movie with the given ID, or null if there isn't one.",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.resolveMovie,
+			},
+			"movies": &graphql.Field{
+				Type:        graphql.NewNonNull(moviePageType),
+				Description: "A page of movies, filtered and sorted in the same way as GET /v1/movies.",
+				Args: graphql.FieldConfigArgument{
+					"title":    &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "", Description: "Only include movies whose title contains all of these words."},
+					"genres":   &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), DefaultValue: []any{}, Description: "Only include movies with all of these genres."},
+					"page":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20, Description: "The number of movies on each page (at most 100)."},
+					"sort":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String)), DefaultValue: []any{"id"}, Description: "Sort keys, in order of precedence, like [\"-year\", \"title\"]. A leading hyphen sorts in descending order."},
+				},
+				Resolve: app.resolveMovies,
+			},
+			"genres": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(genreType))),
+				Description: "Every genre which at least one movie has, in alphabetical order.",
+				Resolve:     app.resolveGenres,
+			},
+		},
+	})
+
+	createInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateMovieInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"year":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"runtime": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.Int), Description: "The runtime in minutes."},
+			"genres":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+		},
+	})
+
+	updateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "UpdateMovieInput",
+		Description: "The fields to change. Fields which are left out (or null) are not changed.",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"year":    &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"runtime": &graphql.InputObjectFieldConfig{Type: graphql.Int, Description: "The runtime in minutes."},
+			"genres":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createMovie": &graphql.Field{
+				Type:        movieType,
+				Description: "Create a movie. Unless force is true, this fails with a duplicate_movie error if a movie with the same or a similar title already exists.",
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createInput)},
+					"force": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+				},
+				Resolve: app.resolveCreateMovie,
+			},
+			"updateMovie": &graphql.Field{
+				Type:        movieType,
+				Description: "Change some or all of a movie's fields.",
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateInput)},
+				},
+				Resolve: app.resolveUpdateMovie,
+			},
+			"deleteMovie": &graphql.Field{
+				Type:        graphql.Boolean,
+				Description: "Delete a movie. Returns true if it was deleted.",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.resolveDeleteMovie,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+}
+
+// metadataField returns a field of the PageMetadata type, which reads one of the fields
+// of data.Metadata.
+func metadataField(get func(data.Metadata) int) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Int),
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return get(p.Source.(data.Metadata)), nil
+		},
+	}
+}
+
+// moviePage holds the result of the movies query.
+type moviePage struct {
+	movies   []*data.Movie
+	metadata data.Metadata
+}
+
+// graphqlID converts the value of an ID argument to a movie ID. IDs which aren't valid
+// movie IDs are returned as 0, which never matches a movie.
+func graphqlID(value any) int64 {
+	s, _ := value.(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0
+	}
+	return id
+}
+
+// graphqlStrings converts the value of a list of strings argument to a []string.
+func graphqlStrings(value any) []string {
+	list, _ := value.([]any)
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		s, _ := item.(string)
+		strs = append(strs, s)
+	}
+	return strs
+}
+
+func (app *application) resolveMovie(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	id := graphqlID(p.Args["id"])
+	if id == 0 {
+		return nil, nil
+	}
+
+	movie, err := app.movies(state.r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, app.graphqlServerError(state.r, err)
+		}
+	}
+	return movie, nil
+}
+
+func (app *application) resolveMovies(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	title, _ := p.Args["title"].(string)
+	genres := graphqlStrings(p.Args["genres"])
+
+	// The filters are the same as for GET /v1/movies, except that the total number of
+	// records is always counted exactly, and there are no pagination links, as there
+	// is no URL for each page.
+	filters := data.Filters{
+		Page:         p.Args["page"].(int),
+		PageSize:     p.Args["pageSize"].(int),
+		Sort:         graphqlStrings(p.Args["sort"]),
+		SortSafelist: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+		Total:        data.TotalExact,
+	}
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		// ValidateFilters() reports the page size under the name of the query string
+		// parameter, so we rename it to match the argument.
+		if message, ok := v.Errors["page_size"]; ok {
+			delete(v.Errors, "page_size")
+			v.Errors["pageSize"] = message
+		}
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	movies, metadata, err := app.movies(state.r).GetAll(title, genres, filters, data.FieldSet{})
+	if err != nil {
+		return nil, app.graphqlServerError(state.r, err)
+	}
+	return moviePage{movies: movies, metadata: metadata}, nil
+}
+
+func (app *application) resolveGenres(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	genres, err := app.movies(state.r).GetGenres()
+	if err != nil {
+		return nil, app.graphqlServerError(state.r, err)
+	}
+	return genres, nil
+}
+
+// The resolveSimilarMovies() method resolves the Movie.similar field. The candidates
+// for each movie are loaded in batches, and then ranked with the configured scorer, in
+// the same way as for GET /v1/movies/:id/similar, except that at most
+// -graphql-similar-candidates candidates are scored for each movie.
+func (app *application) resolveSimilarMovies(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	movie := p.Source.(*data.Movie)
+	first := p.Args["first"].(int)
+
+	v := validator.New()
+	v.Check(first > 0, "first", "must be greater than zero")
+	v.Check(first <= 100, "first", "must be a maximum of 100")
+	if !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	load := state.similar.load(movie.ID)
+	return func() (any, error) {
+		candidates, err := load()
+		if err != nil {
+			return nil, app.graphqlServerError(state.r, err)
+		}
+		results := recommender.Rank(app.similar, movie, candidates)
+		return results[:min(first, len(results))], nil
+	}, nil
+}
+
+// The resolveGenreMovies() method resolves the Genre.movies field, loading the movies
+// for each genre in batches.
+func (app *application) resolveGenreMovies(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	genre := p.Source.(*data.Genre)
+	first := p.Args["first"].(int)
+
+	v := validator.New()
+	v.Check(first > 0, "first", "must be greater than zero")
+	v.Check(first <= 100, "first", "must be a maximum of 100")
+	if !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	load := state.genreMovies.load(genreMoviesKey{genre: genre.Name, limit: first})
+	return func() (any, error) {
+		movies, err := load()
+		if err != nil {
+			return nil, app.graphqlServerError(state.r, err)
+		}
+		return movies, nil
+	}, nil
+}
+
+// The resolveCreateMovie() method creates a movie in the same way as
+// createMovieHandler(): the movie is validated, checked for duplicates (unless force is
+// true) and then inserted.
+func (app *application) resolveCreateMovie(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	input := p.Args["input"].(map[string]any)
+	force, _ := p.Args["force"].(bool)
+
+	movie := &data.Movie{
+		Title:   input["title"].(string),
+		Year:    int32(input["year"].(int)),
+		Runtime: data.Runtime(input["runtime"].(int)),
+		Genres:  graphqlStrings(input["genres"]),
+	}
+	v := validator.New()
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	if !force {
+		duplicates, err := app.movies(state.r).FindDuplicates(movie, app.config.duplicates.threshold)
+		if err != nil {
+			return nil, app.graphqlServerError(state.r, err)
+		}
+		if len(duplicates) > 0 {
+			list := make([]map[string]any, len(duplicates))
+			for i, duplicate := range duplicates {
+				list[i] = map[string]any{
+					"id":         strconv.FormatInt(duplicate.Movie.ID, 10),
+					"title":      duplicate.Movie.Title,
+					"year":       duplicate.Movie.Year,
+					"similarity": duplicate.Similarity,
+					"exact":      duplicate.Exact,
+				}
+			}
+			message := "a movie with the same or a similar title already exists, set force to true to create it anyway"
+			return nil, &graphqlError{code: "duplicate_movie", message: message, extra: map[string]any{"duplicates": list}}
+		}
+	}
+
+	err := app.movies(state.r).Insert(movie)
+	if err != nil {
+		return nil, app.graphqlServerError(state.r, err)
+	}
+	return movie, nil
+}
+
+// The resolveUpdateMovie() method updates a movie in the same way as
+// updateMovieHandler(). Fields which are missing from the input (or null) are left
+// unchanged.
+func (app *application) resolveUpdateMovie(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	input := p.Args["input"].(map[string]any)
+
+	movie, err := app.movies(state.r).Get(graphqlID(p.Args["id"]))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, &graphqlError{code: "not_found", message: "the requested resource could not be found"}
+		default:
+			return nil, app.graphqlServerError(state.r, err)
+		}
+	}
+
+	if title, ok := input["title"].(string); ok {
+		movie.Title = title
+	}
+	if year, ok := input["year"].(int); ok {
+		movie.Year = int32(year)
+	}
+	if runtime, ok := input["runtime"].(int); ok {
+		movie.Runtime = data.Runtime(runtime)
+	}
+	if genres, ok := input["genres"].([]any); ok {
+		movie.Genres = graphqlStrings(genres)
+	}
+
+	v := validator.New()
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		return nil, graphqlValidationError(v.Errors)
+	}
+
+	err = app.movies(state.r).Update(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, &graphqlError{code: "edit_conflict", message: "unable to update the record due to an edit conflict, please try again"}
+		default:
+			return nil, app.graphqlServerError(state.r, err)
+		}
+	}
+	return movie, nil
+}
+
+func (app *application) resolveDeleteMovie(p graphql.ResolveParams) (any, error) {
+	state := graphqlStateFrom(p.Context)
+	err := app.movies(state.r).Delete(graphqlID(p.Args["id"]))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, &graphqlError{code: "not_found", message: "the requested resource could not be found"}
+		default:
+			return nil, app.graphqlServerError(state.r, err)
+		}
+	}
+	return true, nil
+}
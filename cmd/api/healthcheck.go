@@ -1,20 +1,169 @@
 package main
 
 import (
+	"GoFurtherWebPractice/internal/data"
+	"context"
+	"fmt"
 	"net/http"
+	"time"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	// Declare an envelope map containing the data for the response. Notice that the way
 	// we've constructed this means the environment and version data will now be nested // under a system_info key in the JSON response.
+	// The profile for the environment is reported by name only, as this endpoint is
+	// public and the values of the settings it controls aren't for clients to see.
 	env := envelope{
-		"status": "available", "system_info": map[string]string{
+		"status": "available", "system_info": envelope{
 			"environment": app.config.env,
-			"version":     version},
+			"profile": envelope{
+				"name": app.config.env,
+			},
+			"version": version},
 	}
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.render(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		// Use the new serverErrorResponse() helper.
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The livenessHandler() method reports that the process is up and able to serve
+// requests. It deliberately doesn't check any dependencies, so that the orchestrator
+// only restarts us if we've stopped responding altogether, and not when (say) the
+// database is briefly unavailable. It keeps reporting that we're alive while we drain
+// requests during a graceful shutdown.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{"status": "pass", "draining": app.draining.Load()}
+	err := app.render(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readinessHandler() method reports whether we're ready to take traffic. It checks
+// that the database responds to a ping within the configured timeout, that the schema
+// migrations applied to it are the version that this binary expects, and how close the
+// connection pool is to running out of connections. Each check has a status of "pass",
+// "warn" or "fail". If any of them fail, or if we're draining requests during a
+// graceful shutdown, we send a 503 Service Unavailable response so that the
+// orchestrator stops sending us traffic; the per-check details are included either way.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := envelope{
+		"database":        app.checkDatabase(r),
+		"migrations":      app.checkMigrations(r),
+		"connection_pool": app.checkConnectionPool(),
+	}
+
+	status := "pass"
+	for _, check := range checks {
+		if check.(envelope)["status"] == "fail" {
+			status = "fail"
+		}
+	}
+	if app.draining.Load() {
+		status = "draining"
+	}
+
+	code := http.StatusOK
+	if status != "pass" {
+		code = http.StatusServiceUnavailable
+	}
+
+	env := envelope{
+		"status": status,
+		"checks": checks,
+		"system_info": map[string]string{
+			"environment": app.config.env,
+			"version":     version,
+		},
+	}
+	// Make sure that nothing between us and the orchestrator caches the result.
+	headers := http.Header{"Cache-Control": []string{"no-store"}}
+	err := app.render(w, r, code, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkDatabase() method pings the database, giving up after the configured
+// timeout. The details of any error are logged rather than sent in the response, as
+// they can include things like the address of the database server.
+func (app *application) checkDatabase(r *http.Request) envelope {
+	if app.db == nil {
+		return envelope{"status": "fail", "error": "no database connection pool"}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.dbTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := app.db.PingContext(ctx)
+	latency := time.Since(start)
+	if err != nil {
+		app.logError(r, err)
+		return envelope{"status": "fail", "error": "unable to ping the database", "latency": latency.String()}
+	}
+	return envelope{"status": "pass", "latency": latency.String()}
+}
+
+// The checkMigrations() method checks that the last migration applied to the database
+// is the one that this binary expects, and that it didn't fail part way through.
+func (app *application) checkMigrations(r *http.Request) envelope {
+	if app.db == nil {
+		return envelope{"status": "fail", "error": "no database connection pool"}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.config.healthcheck.dbTimeout)
+	defer cancel()
+
+	current, dirty, err := app.models.Schema.Version(ctx)
+	if err != nil {
+		app.logError(r, err)
+		return envelope{"status": "fail", "error": "unable to read the schema version", "expected_version": data.SchemaVersion}
+	}
+
+	check := envelope{"status": "pass", "version": current, "expected_version": data.SchemaVersion, "dirty": dirty}
+	switch {
+	case dirty:
+		check["status"] = "fail"
+		check["error"] = "the last migration failed and needs fixing by hand"
+	case current != data.SchemaVersion:
+		check["status"] = "fail"
+		check["error"] = fmt.Sprintf("expected schema version %d, found %d", data.SchemaVersion, current)
+	}
+	return check
+}
+
+// The checkConnectionPool() method reports the state of the database connection pool.
+// The saturation is the fraction of the maximum number of open connections which are
+// in use. If it reaches the configured threshold we warn that the pool is close to
+// running out, but that alone doesn't make us unready, as requests will just wait for
+// a connection to be freed.
+func (app *application) checkConnectionPool() envelope {
+	if app.db == nil {
+		return envelope{"status": "fail", "error": "no database connection pool"}
+	}
+
+	stats := app.db.Stats()
+	check := envelope{
+		"status":           "pass",
+		"open":             stats.OpenConnections,
+		"in_use":           stats.InUse,
+		"idle":             stats.Idle,
+		"max_open":         stats.MaxOpenConnections,
+		"wait_count":       stats.WaitCount,
+		"wait_duration":    stats.WaitDuration.String(),
+		"saturation_ratio": 0.0,
+	}
+	// A MaxOpenConnections of zero means that there's no limit, so the pool can never
+	// be saturated.
+	if stats.MaxOpenConnections > 0 {
+		saturation := float64(stats.InUse) / float64(stats.MaxOpenConnections)
+		check["saturation_ratio"] = saturation
+		if saturation >= app.config.healthcheck.poolWarnThreshold {
+			check["status"] = "warn"
+		}
+	}
+	return check
+}
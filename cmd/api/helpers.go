@@ -1,6 +1,7 @@
 package main
 
 import (
+	"GoFurtherWebPractice/internal/data"
 	"GoFurtherWebPractice/internal/validator"
 	"encoding/json"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
 
@@ -20,38 +22,47 @@ type envelope map[string]any
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readIDParamNamed(r, "id")
+}
+
+// The readIDParamNamed() helper works in the same way as readIDParam(), but for routes
+// which have more than one ID parameter, like /v1/movies/:id/merge/:other_id.
+func (app *application) readIDParamNamed(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
 
-// Change the data parameter to have the type envelope instead of any.
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// Use the json.MarshalIndent() function so that whitespace is added to the encoded
-	// JSON. Here we use no line prefix ("") and tab indents ("\t") for each element.
-	js, err := json.MarshalIndent(data, "", "\t")
-	if err != nil {
-		return err
+// httprouter doesn't allow a static path segment to share its position with a named
+// parameter, so a route like GET /v1/movies/suggest can't be registered alongside GET
+// /v1/movies/:id. The staticIDParam() helper works around this by dispatching requests
+// whose "id" parameter is exactly the given segment to the static handler, and all
+// other requests to the next handler.
+func (app *application) staticIDParam(segment string, static, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if params.ByName("id") == segment {
+			static(w, r)
+			return
+		}
+		next(w, r)
 	}
-	// Append a newline to make it easier to view in terminal applications.
-	js = append(js, '\n')
-	// At this point, we know that we won't encounter any more errors before writing the
-	// response, so it's safe to add any headers that we want to include. We loop
-	// through the header map and add each header to the http.ResponseWriter header map.
-	// Note that it's OK if the provided header map is nil. Go doesn't throw an error
-	// if you try to range over (or generally, read from) a nil map.
-	for key, value := range headers {
-		w.Header()[key] = value
+}
+
+// The pretty() helper reports whether the JSON (or XML) in the response to the request
+// should be indented. Clients can choose with the pretty query string parameter (like
+// ?pretty=false). If they don't, it depends on the -pretty-responses setting, which is
+// off in the production profile to save bandwidth. Values which can't be parsed as a boolean are
+// ignored, as this parameter is accepted by every endpoint.
+func (app *application) pretty(r *http.Request) bool {
+	pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if err != nil {
+		return app.config.prettyResponses
 	}
-	// Add the "Content-Type: application/json" header, then write the status code and
-	// JSON response.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(js)
-	return nil
+	return pretty
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
@@ -164,3 +175,83 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// The readBool() helper reads a string value from the query string and converts it to a
+// bool before returning. It accepts the same values as strconv.ParseBool(), such as
+// "true", "false", "1" and "0". If no matching key could be found it returns the
+// provided default value, and if the value couldn't be converted then we record an
+// error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// movieLinks holds the hypermedia links which are sent along with every movie, pointing
+// at the movie itself and its related sub-resources.
+type movieLinks struct {
+	Self    string `json:"self"`
+	Similar string `json:"similar"`
+}
+
+// The paginationHeaders() helper returns a header map containing an RFC 8288 Link
+// header for the pagination links in the given metadata (if there are any).
+func (app *application) paginationHeaders(metadata data.Metadata) http.Header {
+	headers := make(http.Header)
+	if metadata.Links == nil {
+		return headers
+	}
+	links := []struct{ rel, url string }{
+		{"self", metadata.Links.Self},
+		{"first", metadata.Links.First},
+		{"prev", metadata.Links.Prev},
+		{"next", metadata.Links.Next},
+		{"last", metadata.Links.Last},
+	}
+	var values []string
+	for _, link := range links {
+		if link.url != "" {
+			values = append(values, fmt.Sprintf(`<%s>; rel="%s"`, link.url, link.rel))
+		}
+	}
+	headers.Set("Link", strings.Join(values, ", "))
+	return headers
+}
+
+// The background() helper accepts an arbitrary function as a parameter, and runs it in
+// a background goroutine which is tracked by the application's WaitGroup, so that
+// graceful shutdown waits for it to finish. Any panic in the function is recovered and
+// logged, rather than bringing down the whole application.
+func (app *application) background(fn func()) {
+	// Increment the WaitGroup counter.
+	app.wg.Add(1)
+
+	// Launch the background goroutine.
+	go func() {
+		// Use defer to decrement the WaitGroup counter before the goroutine returns.
+		defer app.wg.Done()
+
+		// Recover any panic.
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("panic in background task: %v", err), "stack", string(debug.Stack()))
+			}
+		}()
+
+		// Execute the arbitrary function that we passed as the parameter.
+		fn()
+	}()
+}
+
+// The movies() helper returns the movie model to use for the request, which tags every
+// query it runs with the request ID.
+func (app *application) movies(r *http.Request) data.MovieStore {
+	return app.models.Movies.WithRequestID(requestID(r))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets holds the upper bounds, in seconds, of the buckets in each request
+// latency histogram. These are the same as the default buckets used by the Prometheus
+// client libraries.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The metrics type holds the application's request metrics. The counters are expvar
+// types, but they aren't published when they are created, so that we can make more than
+// one application in the same process. Instead main() publishes them once at startup
+// (see publishMetrics()), and the same values are rendered in the Prometheus text
+// format by the prometheusHandler() method.
+type metrics struct {
+	totalRequestsReceived      *expvar.Int
+	totalResponsesSent         *expvar.Int
+	totalProcessingTimeMicros  *expvar.Int
+	totalResponsesSentByStatus *expvar.Map
+	requestDuration            *expvar.Map
+}
+
+// The newMetrics() function returns a new metrics struct with all the counters at zero.
+func newMetrics() *metrics {
+	return &metrics{
+		totalRequestsReceived:      new(expvar.Int),
+		totalResponsesSent:         new(expvar.Int),
+		totalProcessingTimeMicros:  new(expvar.Int),
+		totalResponsesSentByStatus: new(expvar.Map).Init(),
+		requestDuration:            new(expvar.Map).Init(),
+	}
+}
+
+// The publishMetrics() method registers the metrics, along with the application
+// version, the number of goroutines and the database connection pool statistics, with
+// the expvar package so that they appear in the /debug/vars output. Like
+// expvar.Publish(), it panics if it's called more than once.
+func (app *application) publishMetrics() {
+	expvar.NewString("version").Set(version)
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("database", expvar.Func(func() any {
+		if app.db == nil {
+			return nil
+		}
+		return app.db.Stats()
+	}))
+	expvar.Publish("timestamp", expvar.Func(func() any {
+		return time.Now().Unix()
+	}))
+	expvar.Publish("total_requests_received", app.metrics.totalRequestsReceived)
+	expvar.Publish("total_responses_sent", app.metrics.totalResponsesSent)
+	expvar.Publish("total_processing_time_μs", app.metrics.totalProcessingTimeMicros)
+	expvar.Publish("total_responses_sent_by_status", app.metrics.totalResponsesSentByStatus)
+	expvar.Publish("request_duration_seconds", app.metrics.requestDuration)
+}
+
+// The recordMetrics() middleware counts every request and response, the responses sent
+// with each status code, and the total time spent processing requests.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		app.metrics.totalRequestsReceived.Add(1)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		app.metrics.totalResponsesSent.Add(1)
+		app.metrics.totalResponsesSentByStatus.Add(strconv.Itoa(sw.status), 1)
+		app.metrics.totalProcessingTimeMicros.Add(time.Since(start).Microseconds())
+	})
+}
+
+// The observeLatency() method wraps the handler for a route, recording how long each
+// request takes in a latency histogram for the route. The route is identified by its
+// method and path pattern, in the same way as for the rate limiter.
+func (app *application) observeLatency(route string, next http.HandlerFunc) http.HandlerFunc {
+	h := newLatencyHistogram()
+	app.metrics.requestDuration.Set(route, h)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		h.observe(time.Since(start).Seconds())
+	}
+}
+
+// The latencyHistogram type counts request latencies in the latencyBuckets. It
+// implements the expvar.Var interface so that it can be published in an expvar.Map.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+// The observe() method adds a latency, in seconds, to the histogram. Only the first
+// bucket the latency fits in is incremented; the counts are made cumulative when the
+// histogram is read.
+func (h *latencyHistogram) observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// The snapshot() method returns the cumulative bucket counts (in the same order as
+// latencyBuckets), the total number of observations and their sum.
+func (h *latencyHistogram) snapshot() ([]uint64, uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cumulative := make([]uint64, len(h.counts))
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		cumulative[i] = total
+	}
+	return cumulative, h.count, h.sum
+}
+
+// String() implements the expvar.Var interface, returning the histogram as a JSON
+// object.
+func (h *latencyHistogram) String() string {
+	buckets, count, sum := h.snapshot()
+
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	for i, upper := range latencyBuckets {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, `"%s": %d`, formatFloat(upper), buckets[i])
+	}
+	fmt.Fprintf(&b, `}, "count": %d, "sum": %s}`, count, formatFloat(sum))
+	return b.String()
+}
+
+// The prometheusHandler() method writes the same metrics as /debug/vars in the
+// Prometheus text exposition format.
+func (app *application) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	writeMetric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	writeMetric("greenlight_requests_received_total", "counter", "Total number of HTTP requests received.", app.metrics.totalRequestsReceived.Value())
+	writeMetric("greenlight_responses_sent_total", "counter", "Total number of HTTP responses sent.", app.metrics.totalResponsesSent.Value())
+	writeMetric("greenlight_processing_time_seconds_total", "counter", "Total time spent processing HTTP requests.",
+		formatFloat(float64(app.metrics.totalProcessingTimeMicros.Value())/1e6))
+
+	b.WriteString("# HELP greenlight_responses_sent_by_status_total Total number of HTTP responses sent, by status code.\n")
+	b.WriteString("# TYPE greenlight_responses_sent_by_status_total counter\n")
+	app.metrics.totalResponsesSentByStatus.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(&b, "greenlight_responses_sent_by_status_total{status=%s} %s\n", labelValue(kv.Key), kv.Value)
+	})
+
+	b.WriteString("# HELP greenlight_request_duration_seconds HTTP request latency, by route.\n")
+	b.WriteString("# TYPE greenlight_request_duration_seconds histogram\n")
+	app.metrics.requestDuration.Do(func(kv expvar.KeyValue) {
+		h, ok := kv.Value.(*latencyHistogram)
+		if !ok {
+			return
+		}
+		route := labelValue(kv.Key)
+		buckets, count, sum := h.snapshot()
+		for i, upper := range latencyBuckets {
+			fmt.Fprintf(&b, "greenlight_request_duration_seconds_bucket{route=%s,le=\"%s\"} %d\n", route, formatFloat(upper), buckets[i])
+		}
+		fmt.Fprintf(&b, "greenlight_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", route, count)
+		fmt.Fprintf(&b, "greenlight_request_duration_seconds_sum{route=%s} %s\n", route, formatFloat(sum))
+		fmt.Fprintf(&b, "greenlight_request_duration_seconds_count{route=%s} %d\n", route, count)
+	})
+
+	writeMetric("go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+
+	// The database statistics come straight from the sql.DB connection pool.
+	if app.db != nil {
+		stats := app.db.Stats()
+		writeMetric("greenlight_db_max_open_connections", "gauge", "Maximum number of open connections to the database.", stats.MaxOpenConnections)
+		writeMetric("greenlight_db_open_connections", "gauge", "Number of established connections, both in use and idle.", stats.OpenConnections)
+		writeMetric("greenlight_db_in_use_connections", "gauge", "Number of connections currently in use.", stats.InUse)
+		writeMetric("greenlight_db_idle_connections", "gauge", "Number of idle connections.", stats.Idle)
+		writeMetric("greenlight_db_wait_count_total", "counter", "Total number of connections waited for.", stats.WaitCount)
+		writeMetric("greenlight_db_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.", formatFloat(stats.WaitDuration.Seconds()))
+		writeMetric("greenlight_db_max_idle_closed_total", "counter", "Total number of connections closed due to SetMaxIdleConns.", stats.MaxIdleClosed)
+		writeMetric("greenlight_db_max_idle_time_closed_total", "counter", "Total number of connections closed due to SetConnMaxIdleTime.", stats.MaxIdleTimeClosed)
+		writeMetric("greenlight_db_max_lifetime_closed_total", "counter", "Total number of connections closed due to SetConnMaxLifetime.", stats.MaxLifetimeClosed)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// formatFloat formats a float in the shortest form which represents it exactly.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labelValue quotes a Prometheus label value, escaping any backslashes, double quotes
+// and newlines in it.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"GoFurtherWebPractice/internal/validator"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The assignRequestID() middleware gives every request an ID, which is stored in the
+// request context and echoed back to the client in the X-Request-ID response header.
+// If the client (or a proxy in front of us) already sent an X-Request-ID header we
+// reuse its value, as long as it's in a sensible format, so that the ID can be followed
+// across services. Otherwise we generate a random one.
+func (app *application) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validator.Matches(id, validator.RequestIDRX) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// The enableCORS() middleware lets browser front-ends on the trusted origins in the
+// config call the API. For requests from a trusted origin we set the
+// Access-Control-Allow-Origin header (and expose the response headers that clients need
+// to read), so that the browser will let the front-end see the response. Preflight
+// requests are passed on to the router, which answers them through its automatic
+// OPTIONS handling (see preflightHandler()).
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Add the "Vary: Origin" header, as the response will differ depending on the
+		// origin of the request.
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && validator.PermittedValue(origin, app.config.cors.trustedOrigins...) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The preflightHandler() method answers the OPTIONS requests which httprouter handles
+// automatically. By the time it's called, the router has already set the Allow header
+// to the methods registered for the requested path. If the request is a CORS preflight
+// request from a trusted origin (which enableCORS() will have marked by setting the
+// Access-Control-Allow-Origin header), we tell the browser that it may use those
+// methods and our allowed request headers.
+func (app *application) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if r.Header.Get("Access-Control-Request-Method") != "" && w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", w.Header().Get("Allow"))
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Define the response headers which browser front-ends are allowed to read, and the
+// request headers that they are allowed to send.
+const (
+	corsExposedHeaders = "ETag, Link, Location, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Idempotent-Replayed, X-Request-ID, Deprecation, Sunset"
+	corsAllowedHeaders = "Authorization, Content-Type, Idempotency-Key, X-Request-ID"
+)
+
+// The recoverPanic() middleware recovers from any panic in the handler chain, so that
+// the client gets a proper 500 Internal Server Error response rather than having the
+// connection dropped. The panic and its stack trace are logged along with details of
+// the request that caused it.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Create a deferred function (which will always be run in the event of a panic
+		// as Go unwinds the stack).
+		defer func() {
+			// Use the builtin recover function to check if there has been a panic or
+			// not.
+			if pv := recover(); pv != nil {
+				// http.ErrAbortHandler is used to deliberately abort a response, so
+				// let the server deal with it as it normally would.
+				if pv == http.ErrAbortHandler {
+					panic(pv)
+				}
+				// If there was a panic, set a "Connection: close" header on the
+				// response. This acts as a trigger to make Go's HTTP server
+				// automatically close the current connection after a response has been
+				// sent.
+				w.Header().Set("Connection", "close")
+				app.panicResponse(w, r, fmt.Errorf("%v", pv), debug.Stack())
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The logRequest() middleware writes an access log entry for every request, once the
+// response has been sent, including the response status, the number of bytes in the
+// response body and how long the request took to handle.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		// If the handler didn't write anything at all, the server sends a 200 OK.
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		app.logger.Info("request",
+			"method", r.Method,
+			"uri", r.URL.RequestURI(),
+			"remote_addr", r.RemoteAddr,
+			"request_id", requestID(r),
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"latency", time.Since(start),
+		)
+	})
+}
+
+// The statusWriter type wraps a http.ResponseWriter to keep track of the status code
+// and the number of bytes written, for use in the access log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Unwrap() returns the underlying http.ResponseWriter, so that http.ResponseController
+// can reach it.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// The rateLimit() method returns a middleware function which applies per-client token
+// bucket rate limiting to a route. Clients are identified by their IP address (see
+// clientIP()). Each route is identified by its method and path pattern, like "GET
+// /v1/movies/:id". Routes which have an override in the config get their own set of
+// token buckets with the override's limits, and all other routes share a single set of
+// buckets using the default limits. If the limiter is disabled, the middleware function
+// returns the handler unchanged.
+func (app *application) rateLimit() func(route string, next http.HandlerFunc) http.HandlerFunc {
+	global := newRateLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
+	return func(route string, next http.HandlerFunc) http.HandlerFunc {
+		if !app.config.limiter.enabled {
+			return next
+		}
+
+		limiter := global
+		if override, ok := app.config.limiter.routes[route]; ok {
+			limiter = newRateLimiter(override.rps, override.burst)
+		}
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			ip, err := app.clientIP(r)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			allowed, remaining, retryAfter, reset := limiter.allow(ip)
+
+			// Let the client know where it stands with the RateLimit-* headers from
+			// the IETF draft, on every response.
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limiter.burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+
+			if !allowed {
+				// Tell the client how long it will be until there's a token available
+				// for its next request.
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// The rateLimiter type holds a token bucket for each client which has made a request
+// recently, along with the limits that new buckets are created with.
+type rateLimiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*rateLimiterClient
+}
+
+// Define a client struct to hold the rate limiter and last seen time for each client.
+type rateLimiterClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// The newRateLimiter() function returns a new rateLimiter, and launches a background
+// goroutine which removes old entries from its clients map once every minute, so that
+// the map doesn't grow without bound.
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	rl := &rateLimiter{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*rateLimiterClient),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			rl.mu.Lock()
+			for ip, client := range rl.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(rl.clients, ip)
+				}
+			}
+			rl.mu.Unlock()
+		}
+	}()
+
+	return rl
+}
+
+// The allow() method takes a token from the client's bucket, initializing a new bucket
+// for the client if we haven't seen it before. It reports whether the request is
+// allowed, how many whole tokens are left in the bucket, how long it will be until the
+// next token is available, and how long it will be until the bucket is full again.
+func (rl *rateLimiter) allow(ip string) (bool, int, time.Duration, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	client, found := rl.clients[ip]
+	if !found {
+		client = &rateLimiterClient{limiter: rate.NewLimiter(rate.Limit(rl.rps), rl.burst)}
+		rl.clients[ip] = client
+	}
+	now := time.Now()
+	client.lastSeen = now
+
+	allowed := client.limiter.AllowN(now, 1)
+	tokens := max(0, client.limiter.TokensAt(now))
+	retryAfter := time.Duration(max(0, 1-tokens) / rl.rps * float64(time.Second))
+	reset := time.Duration((float64(rl.burst) - tokens) / rl.rps * float64(time.Second))
+	return allowed, int(tokens), retryAfter, reset
+}
+
+// The clientIP() method returns the IP address of the client which made the request.
+// Normally this is just the remote address of the connection. But if the connection
+// comes from one of the trusted proxies in the config, we use the X-Forwarded-For header
+// instead: working from the right (the entry added by the proxy nearest to us), we skip
+// over any trusted proxies and take the first address that isn't one. Entries further
+// left could have been made up by the client, so they are never used unless all the
+// others are trusted proxies.
+func (app *application) clientIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", err
+	}
+	if !app.isTrustedProxy(addr) {
+		return addr.String(), nil
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(entry))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next, err := netip.ParseAddr(forwarded[i])
+		if err != nil {
+			// Stop at the first entry which isn't a valid IP address; nothing to the
+			// left of it can be trusted.
+			break
+		}
+		addr = next
+		if !app.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr.Unmap().String(), nil
+}
+
+// The isTrustedProxy() method reports whether the address belongs to one of the
+// trusted proxies in the config.
+func (app *application) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range app.config.limiter.trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// The idempotent() middleware adds support for the Idempotency-Key request header to
+// the wrapped handler, so that clients can safely retry non-idempotent requests (like
+// POST /v1/movies) without the risk of the action being performed twice. The first
+// response for each key is stored, and replayed to any later request which uses the
+// same key and has the same method, path and body. Keys are scoped to the client which
+// sent them (see idempotencyScope()), so clients which happen to choose the same key
+// don't see each other's responses. Requests which don't include the header are passed
+// straight through to the next handler.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key header must not be more than 255 bytes long"))
+			return
+		}
+
+		// Read the request body so that we can hash it, limiting it to the same 1MB
+		// that readJSON() allows, and then replace it with a fresh reader so that the
+		// next handler can read it again.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		scope, err := app.idempotencyScope(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		reservation, stored, err := app.models.IdempotencyKeys.Reserve(scope+" "+key, requestHash, app.config.idempotency.ttl, app.config.idempotency.lease)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				app.idempotencyKeyMismatchResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyKeyInFlight):
+				app.idempotencyKeyInFlightResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// If we already have a response for this key, replay it to the client. Headers
+		// which have already been set for this request by the middleware further up the
+		// chain (like X-Request-ID) take precedence over the stored ones.
+		if stored != nil {
+			for name, values := range stored.Headers {
+				if _, exists := w.Header()[name]; !exists {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// Otherwise call the next handler, recording the response that it sends. If
+		// the handler panics or we don't end up storing the response, release the key
+		// so that the client can try again.
+		completed := false
+		defer func() {
+			if !completed {
+				err := app.models.IdempotencyKeys.Release(reservation)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Server errors are usually transient, so we don't want to keep replaying them
+		// to a client that retries.
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+
+		err = app.models.IdempotencyKeys.Complete(reservation, &data.IdempotentResponse{
+			Status:  rec.status,
+			Headers: rec.header,
+			Body:    rec.body.Bytes(),
+		})
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// The idempotencyScope() method returns the scope that the client's idempotency keys
+// are stored under: the subject of its TLS client certificate, if it authenticated
+// with one, or otherwise its IP address.
+func (app *application) idempotencyScope(r *http.Request) (string, error) {
+	if p := app.contextGetPrincipal(r); p != nil {
+		return "principal:" + p.Subject, nil
+	}
+	ip, err := app.clientIP(r)
+	if err != nil {
+		return "", err
+	}
+	return "ip:" + ip, nil
+}
+
+// The purgeIdempotencyKeys() method deletes the expired idempotency keys once every
+// idempotencyPurgeInterval, until the stop channel is closed, so that the stored
+// responses for keys which are never reused don't build up in the database.
+func (app *application) purgeIdempotencyKeys(stop <-chan struct{}) {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted, err := app.models.IdempotencyKeys.DeleteExpired()
+			if err != nil {
+				app.logger.Error("unable to purge expired idempotency keys", "error", err.Error())
+				continue
+			}
+			if deleted > 0 {
+				app.logger.Info("purged expired idempotency keys", "deleted", deleted)
+			}
+		}
+	}
+}
+
+// idempotencyPurgeInterval is how often purgeIdempotencyKeys() deletes the expired
+// idempotency keys.
+const idempotencyPurgeInterval = 10 * time.Minute
+
+// The responseRecorder type wraps a http.ResponseWriter, passing everything through to
+// it while also keeping a copy of the status code, headers and body, so that they can
+// be stored by the idempotent() middleware (or checked by the validateOpenAPI()
+// middleware).
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap() returns the underlying http.ResponseWriter, so that http.ResponseController
+// can reach it.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// The compress() middleware compresses response bodies with gzip or deflate, if the
+// client says that it accepts one of them in its Accept-Encoding header. Bodies smaller
+// than the minimum size in the config are sent uncompressed, as are responses which
+// already have a Content-Encoding header. Streaming responses are supported: whenever
+// the handler flushes the response, the compressed data written so far is flushed to
+// the client too.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Accept-Encoding header, so caches need to know to
+		// take it into account.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: app.config.compression.minSize}
+		next.ServeHTTP(cw, r)
+		// Note that we don't defer this, so that if the handler panics, anything in
+		// the buffer is thrown away and the panic recovery middleware can still send
+		// its own response.
+		err := cw.Close()
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+}
+
+// The acceptedEncoding() function returns the content coding (either "gzip" or
+// "deflate") to use for a response, given the value of the request's Accept-Encoding
+// header, or the empty string if the client doesn't accept either of them. We prefer
+// gzip when the client accepts both equally.
+func acceptedEncoding(header string) string {
+	qvalues := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, found := qvalues[coding]
+		if !found {
+			q = qvalues["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// The compressWriter type wraps a http.ResponseWriter, compressing the response body.
+// The start of the body is held back in a buffer until we know whether it's big enough
+// to be worth compressing: that is, until the buffer reaches the minimum size, the
+// handler flushes the response or the handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	encoder interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	// Informational responses are sent straight away, and don't affect the final one.
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.started {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		return len(b), cw.start(true)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// The start() method sends the response headers and any buffered body, compressing the
+// body from now on if compress is true and the response is suitable for it.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.ResponseWriter.Header()
+	if compress && header.Get("Content-Encoding") == "" && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+		header.Set("Content-Encoding", cw.encoding)
+		// The length of the body is about to change, so any Content-Length set by the
+		// handler would be wrong.
+		header.Del("Content-Length")
+		switch cw.encoding {
+		case "gzip":
+			cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+		case "deflate":
+			cw.encoder = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush() implements the http.Flusher interface, so that handlers which stream their
+// responses (using http.ResponseController) can push data to the client as they go.
+// Once a response has been flushed it's always compressed, whatever its size, as more
+// is likely to follow.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		if err := cw.start(true); err != nil {
+			return
+		}
+	}
+	if cw.encoder != nil {
+		if err := cw.encoder.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close() sends anything still held in the buffer, uncompressed because it's smaller
+// than the minimum size, and finishes the compressed stream if there is one.
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		if cw.status == 0 {
+			// The handler didn't write anything at all, so leave it to the server to
+			// send its default response.
+			return nil
+		}
+		return cw.start(false)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// Unwrap() returns the underlying http.ResponseWriter, so that http.ResponseController
+// can reach it.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// The deprecateV1() middleware announces the deprecation of the v1 movie endpoints on
+// every response from them, following the schedule in the -v1-deprecation-date and
+// -v1-sunset-date settings. The Deprecation header (RFC 9745) holds the date from which
+// the endpoints are deprecated, as a structured field date (an @ followed by a Unix
+// timestamp), and the Sunset header (RFC 8594) holds the date after which they may stop
+// working, as a HTTP date. Either header is left out if its date isn't set.
+func (app *application) deprecateV1(next http.Handler) http.Handler {
+	deprecation, sunset := app.config.deprecation.v1Date, app.config.deprecation.v1Sunset
+	if deprecation.IsZero() && sunset.IsZero() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/movies" || strings.HasPrefix(r.URL.Path, "/v1/movies/") {
+			if !deprecation.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(deprecation.Unix(), 10))
+			}
+			if !sunset.IsZero() {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotentScope(t *testing.T) {
+	app, _ := newTestApplication(t)
+	handler := app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+	}{
+		{"first client", "192.0.2.1:1234", "first", http.StatusCreated, false},
+		{"second client with the same key", "192.0.2.2:1234", "second", http.StatusCreated, false},
+		{"first client retries", "192.0.2.1:5678", "first", http.StatusCreated, true},
+		{"second client retries", "192.0.2.2:5678", "second", http.StatusCreated, true},
+		{"first client reuses the key", "192.0.2.1:1234", "second", http.StatusUnprocessableEntity, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(tt.body))
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("Idempotency-Key", "create-movie")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("got replayed %t; want %t", replayed, tt.wantReplayed)
+			}
+			if tt.wantStatus == http.StatusCreated && rr.Body.String() != tt.body {
+				t.Errorf("got body %q; want %q", rr.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestOpenAPIValidationIsRateLimited(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.openapi.validation = "requests"
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 2
+	h := app.routes()
+
+	// The requests which the OpenAPI validation middleware rejects take tokens from
+	// the client's bucket like any other, so once it's empty they're turned away by
+	// the rate limiter instead.
+	for i, want := range []int{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity, http.StatusTooManyRequests} {
+		res := send(t, h, http.MethodGet, "/v1/movies?page=0", "", nil)
+		if res.status != want {
+			t.Errorf("request %d: got status %d; want %d", i+1, res.status, want)
+		}
+	}
+}
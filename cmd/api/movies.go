@@ -1,10 +1,11 @@
 package main
 
 import (
-	"GoFurtherWebPractice/internal/data"      // New import
+	"GoFurtherWebPractice/internal/data" // New import
+	"GoFurtherWebPractice/internal/recommender"
 	"GoFurtherWebPractice/internal/validator" // New import
+	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 )
 
@@ -13,11 +14,14 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// HTTP request body (note that the field names and types in the struct are a subset
 	// of the Movie struct that we created earlier).
 	// This struct will be our *target decode destination*
+	//
+	// The runtime is read as raw JSON, as its format depends on the version of the API
+	// (see readRuntime()).
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"` // Make this field a data.Runtime type.
-		Genres  []string     `json:"genres"`
+		Title   string          `json:"title"`
+		Year    int32           `json:"year"`
+		Runtime json.RawMessage `json:"runtime"`
+		Genres  []string        `json:"genres"`
 	}
 	// Use the new readJSON() helper to decode the request body into the input struct.
 	// If this returns an error we send the client the error message along with a 400
@@ -28,16 +32,24 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	runtime, err := app.readRuntime(r, input.Runtime)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
 
 	// Copy the values from the input struct to a new Movie struct.
 	movie := &data.Movie{
 		Title:   input.Title,
 		Year:    input.Year,
-		Runtime: input.Runtime,
+		Runtime: runtime,
 		Genres:  input.Genres,
 	}
 	// Initialize a new Validator.
 	v := validator.New()
+	// Read the force query string value, which lets editors skip the duplicate check
+	// below when they really do want to create a second movie with the same title.
+	force := app.readBool(r.URL.Query(), "force", false, v)
 	// Call the ValidateMovie() function and return a response containing the errors if
 	// any of the checks fail.
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -45,10 +57,25 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Unless the client has forced the insert, check for existing movies with the same
+	// normalized title and year (or a very similar title), and send a 409 Conflict
+	// response pointing at them if there are any.
+	if !force {
+		duplicates, err := app.movies(r).FindDuplicates(movie, app.config.duplicates.threshold)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if len(duplicates) > 0 {
+			app.duplicateMovieResponse(w, r, duplicates)
+			return
+		}
+	}
+
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.movies(r).Insert(movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -58,10 +85,10 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// empty http.Header map and then use the Set() method to add a new Location header,
 	// interpolating the system-generated ID for our new movie in the URL.
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("Location", moviePath(r, movie.ID))
 	// Write a JSON response with a 201 Created status code, the movie data in the
 	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	err = app.render(w, r, http.StatusCreated, app.dataEnvelope(r, "movie", app.movieResource(r, movie, data.FieldSet{}), nil), headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -74,10 +101,18 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		app.notFoundResponse(w, r)
 		return
 	}
-	// Call the Get() method to fetch the data for a specific movie. We also need to
-	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
+	// Read the fields and include query string values, which let the client choose
+	// which movie fields are sent back.
+	v := validator.New()
+	fields := app.readFieldSet(r)
+	if data.ValidateFieldSet(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Call the GetFields() method to fetch the data for a specific movie. We also need
+	// to use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.movies(r).GetFields(id, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -88,9 +123,20 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Create an envelope{"movie": movie} instance and pass it to writeJSON(), instead
+	// Count the view towards the movie's popularity, which orders the typeahead
+	// suggestions. This happens in the background so that it doesn't slow down the
+	// response, and a failure is only logged.
+	movies := app.movies(r)
+	app.background(func() {
+		err := movies.IncrementPopularity(id)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+
+	// Create an envelope{"movie": movie} instance and pass it to render(), instead
 	// of passing the plain movie struct.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "movie", app.movieResource(r, movie, fields), nil), nil)
 	if err != nil {
 		// Use the new serverErrorResponse() helper.
 		app.serverErrorResponse(w, r, err)
@@ -109,7 +155,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Fetch the existing movie record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.movies(r).Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,10 +167,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title   *string         `json:"title"`
+		Year    *int32          `json:"year"`
+		Runtime json.RawMessage `json:"runtime"`
+		Genres  []string        `json:"genres"`
 	}
 
 	// Read the JSON request body data into the input struct.
@@ -149,8 +195,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	if input.Year != nil {
 		movie.Year = *input.Year
 	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+	// The runtime is read as raw JSON (see createMovieHandler()), so a missing or null
+	// value is an empty slice or the literal null.
+	if len(input.Runtime) > 0 && string(input.Runtime) != "null" {
+		movie.Runtime, err = app.readRuntime(r, input.Runtime)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
 	}
 	if input.Genres != nil {
 		movie.Genres = input.Genres // Note that we don't need to dereference a slice.
@@ -162,16 +214,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Pass the updated movie record to our new Update() method.
-	err = app.models.Movies.Update(movie)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Intercept any ErrEditConflict error and call the new editConflictResponse()
-	// helper.
-	err = app.models.Movies.Update(movie)
+	// Pass the updated movie record to our new Update() method, intercepting any
+	// ErrEditConflict error and calling the new editConflictResponse() helper.
+	err = app.movies(r).Update(movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -183,7 +228,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "movie", app.movieResource(r, movie, data.FieldSet{}), nil), nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -198,7 +243,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.movies(r).Delete(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -208,8 +253,13 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
-	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	// In v2, return a 204 No Content status code with no body. In v1, return a 200 OK
+	// status code along with a success message.
+	if apiVersion(r) == 2 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	err = app.render(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -235,24 +285,183 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Read the page and page_size query string values into the embedded struct.
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	// Read the sort query string value into the embedded struct.
-	input.Filters.Sort = app.readString(qs, "sort", "id")
+	// Read the sort query string value into the embedded struct. This is a
+	// comma-separated list of sort keys, like "-year,title".
+	input.Filters.Sort = app.readCSV(qs, "sort", []string{"id"})
 	// Add the supported sort values for this endpoint to the sort safelist.
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// Read the total query string value, which controls how (and whether) the total
+	// number of matching records is calculated.
+	input.Filters.Total = app.readString(qs, "total", data.TotalExact)
+	// Pass in the request URL so that the pagination links can be generated from it.
+	input.Filters.URL = r.URL
+	// Read the fields and include query string values.
+	fields := app.readFieldSet(r)
 	// Execute the validation checks on the Filters struct and send a response
 	// containing the errors if necessary.
+	data.ValidateFieldSet(v, fields)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	// Accept the metadata struct as a return value.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.movies(r).GetAll(input.Title, input.Genres, input.Filters, fields)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	// Include the metadata in the response envelope, and the pagination links in the
+	// Link header.
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "movies", app.movieResources(r, movies, fields), &metadata), app.paginationHeaders(metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	// Read the prefix to complete and the maximum number of suggestions to return.
+	prefix := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 10, v)
+
+	if data.ValidateSuggestion(v, prefix, limit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.movies(r).Suggest(prefix, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Suggestions don't need to be perfectly fresh, so let clients and any shared
+	// caches in front of the API reuse a response for a short while.
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=60")
+
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "suggestions", suggestions, nil), headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listSimilarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	// Similar movies are always ordered by their similarity score, so that is the only
+	// sort value we accept.
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readCSV(qs, "sort", []string{"-score"}),
+		SortSafelist: []string{"-score"},
+		URL:          r.URL,
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	candidates, err := app.movies(r).GetSimilarCandidates(movie, app.config.similar.maxCandidates)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Rank the candidates using the configured scorer, then cut out the requested page
+	// of results.
+	results := recommender.Rank(app.similar, movie, candidates)
+	start, end, metadata := filters.PageBounds(len(results))
+
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "similar_movies", app.similarResources(r, results[start:end]), &metadata), app.paginationHeaders(metadata))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) mergeMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the IDs of the canonical movie and the duplicate which should be folded
+	// into it.
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	otherID, err := app.readIDParamNamed(r, "other_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(id != otherID, "other_id", "must not be the same as the movie id"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch both records, sending a 404 Not Found response if either doesn't exist.
+	canonical, err := app.movies(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	duplicate, err := app.movies(r).Get(otherID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The canonical movie keeps its own title, year and runtime, and picks up any
+	// genres that only the duplicate had. Make sure that the result is still a valid
+	// movie (for example, that it doesn't end up with more than 5 genres).
+	merged := *canonical
+	merged.Genres = data.MergeGenres(canonical.Genres, duplicate.Genres)
+	if data.ValidateMovie(v, &merged); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.movies(r).Merge(canonical, duplicate, merged.Genres)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.render(w, r, http.StatusOK, app.dataEnvelope(r, "movie", app.movieResource(r, canonical, data.FieldSet{}), nil), nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
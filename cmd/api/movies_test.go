@@ -0,0 +1,57 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestSuggestOrdersByViews(t *testing.T) {
+	app, movies := newTestApplication(t)
+	h := app.routes()
+
+	err := movies.Insert(&data.Movie{Title: "Mean Girls", Year: 2004, Runtime: 97, Genres: []string{"comedy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suggest := func() []int64 {
+		t.Helper()
+
+		res := send(t, h, http.MethodGet, "/v1/movies/suggest?q=m", "", nil)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d; want %d; body: %s", res.status, http.StatusOK, res.body)
+		}
+		var body struct {
+			Suggestions []data.MovieSuggestion `json:"suggestions"`
+		}
+		err := json.Unmarshal(res.body, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, suggestion := range body.Suggestions {
+			ids = append(ids, suggestion.ID)
+		}
+		return ids
+	}
+
+	if got, want := suggest(), []int64{1, 5}; !slices.Equal(got, want) {
+		t.Fatalf("got suggestions %v before any views; want %v", got, want)
+	}
+
+	// Viewing a movie counts towards its popularity, in the background.
+	for range 2 {
+		res := send(t, h, http.MethodGet, "/v1/movies/5", "", nil)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d; want %d; body: %s", res.status, http.StatusOK, res.body)
+		}
+	}
+	app.wg.Wait()
+
+	if got, want := suggest(), []int64{5, 1}; !slices.Equal(got, want) {
+		t.Errorf("got suggestions %v after viewing movie 5; want %v", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/openapi"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// openAPIJSON holds the OpenAPI 3.1 document describing every route in routes(). It's
+// served as it is at /v1/openapi.json, and parsed into openAPIDocument for the
+// validateOpenAPI() middleware. Whenever a route is added or changed, the document
+// must be updated to match; routes() checks that the two list the same routes, and
+// TestOpenAPIContract checks the responses from every operation against it.
+//
+//go:embed openapi.json
+var openAPIJSON []byte
+
+var openAPIDocument = mustParseOpenAPI(openAPIJSON)
+
+func mustParseOpenAPI(js []byte) *openapi.Document {
+	doc, err := openapi.Parse(js)
+	if err != nil {
+		panic(fmt.Sprintf("invalid openapi.json: %s", err))
+	}
+	return doc
+}
+
+// The openAPIHandler() method serves the OpenAPI document. It's always sent as JSON,
+// whatever the client accepts, as that's the only format the document comes in.
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	body := openAPIJSON
+	if !app.pretty(r) {
+		var buf bytes.Buffer
+		err := json.Compact(&buf, openAPIJSON)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		body = buf.Bytes()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(body)
+}
+
+// The checkOpenAPIRoutes() function compares the routes registered with the router
+// (given in the same "METHOD /path/:param" form as for the rate limiter) with the
+// operations in the OpenAPI document, and returns an error listing any which are in one
+// but not the other.
+func checkOpenAPIRoutes(routes []string) error {
+	registered := make(map[string]bool)
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route, " ")
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "{" + segment[1:] + "}"
+			}
+		}
+		registered[method+" "+strings.Join(segments, "/")] = true
+	}
+
+	documented := make(map[string]bool)
+	for _, op := range openAPIDocument.Operations() {
+		documented[op.Method+" "+op.Path] = true
+	}
+
+	var problems []string
+	for route := range registered {
+		if !documented[route] {
+			problems = append(problems, route+" is not in openapi.json")
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			problems = append(problems, route+" is in openapi.json but isn't a route")
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("the OpenAPI document doesn't match the routes: %s", strings.Join(problems, "; "))
+}
+
+// The validateOpenAPI() middleware checks requests against the OpenAPI document, when
+// the -openapi-validation setting is "requests" or "all". A request whose path
+// parameters don't match the document gets a 404 Not Found response, and one whose
+// query string, headers or JSON body don't match gets a 422 Unprocessable Entity
+// response listing the problems, before it reaches the handler. Request bodies which
+// aren't valid JSON are left for the handler to reject with its usual error message.
+// It wraps each route inside the route's rate limiter (see routes()), so that requests
+// which it rejects are still counted against the client's limit.
+//
+// In the "all" mode (the default in the development profile), every response is also
+// checked against the document, and any mismatch is logged as a warning. The response
+// is still sent, so this catches drift between the handlers and the document without
+// breaking clients, for the requests that TestOpenAPIContract doesn't make.
+func (app *application) validateOpenAPI(next http.HandlerFunc) http.HandlerFunc {
+	mode := app.config.openapi.validation
+	if mode != "requests" && mode != "all" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, params := openAPIDocument.Find(r.Method, r.URL.Path)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if errs := op.PathErrors(params); len(errs) > 0 {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		body, err := peekJSONBody(r)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		if errs := op.RequestErrors(r, body); len(errs) > 0 {
+			app.failedValidationResponse(w, r, errs)
+			return
+		}
+
+		if mode != "all" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			return
+		}
+		problems := op.ResponseErrors(rec.status, rec.header.Get("Content-Type"), rec.body.Bytes())
+		if len(problems) > 0 {
+			app.logger.Warn("response doesn't match the OpenAPI document",
+				"operation", op.Method+" "+op.Path,
+				"status", rec.status,
+				"problems", problems,
+				"request_id", requestID(r),
+			)
+		}
+	}
+}
+
+// The peekJSONBody() function decodes the JSON body of a request (if it has one) for
+// validation, and puts the body back so that the handler can read it again. It returns
+// nil if the body is empty, isn't JSON, or is too large for readJSON() to accept.
+func peekJSONBody(r *http.Request) (any, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return nil, nil
+		}
+	}
+
+	// Read one byte more than readJSON() accepts, so that we can tell if the body is
+	// too large.
+	maxBytes := int64(1_048_576)
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > maxBytes {
+		return nil, nil
+	}
+
+	var body any
+	err = json.Unmarshal(buf, &body)
+	if err != nil {
+		return nil, nil
+	}
+	return body, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The contractTest type describes a request to send in TestOpenAPIContract, and the
+// status code it should get. The setup function, if there is one, is called before the
+// request is sent, to put the application into the state that the request needs.
+type contractTest struct {
+	method  string
+	target  string
+	body    string
+	headers http.Header
+	status  int
+	setup   func(app *application, movies *fakeMovieStore)
+}
+
+// contractTests returns the requests for TestOpenAPIContract. Between them, they get
+// every status code documented for every operation, except the default responses.
+func contractTests() []contractTest {
+	tests := []contractTest{
+		{method: http.MethodGet, target: "/v1/healthcheck", status: http.StatusOK},
+		{method: http.MethodGet, target: "/v1/healthcheck/live", status: http.StatusOK},
+		{method: http.MethodGet, target: "/v1/healthcheck/ready", status: http.StatusOK},
+		{method: http.MethodGet, target: "/v1/healthcheck/ready", status: http.StatusServiceUnavailable,
+			setup: func(app *application, _ *fakeMovieStore) { app.draining.Store(true) }},
+		{method: http.MethodGet, target: "/v1/openapi.json", status: http.StatusOK},
+		{method: http.MethodGet, target: "/debug/vars", status: http.StatusOK},
+		{method: http.MethodGet, target: "/metrics", status: http.StatusOK},
+
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusOK,
+			body: graphqlBody(`{ movie(id: "1") { id title year runtime genres version createdAt updatedAt similar(first: 2) { score movie { id title } } } }`, nil)},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusOK,
+			body: graphqlBody(`query($title: String) { movies(title: $title, sort: ["-year"]) { items { id title } metadata { currentPage pageSize firstPage lastPage totalRecords } } genres { name movieCount movies(first: 2) { id } } }`, map[string]any{"title": "o"})},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusOK,
+			body: graphqlBody(`mutation { createMovie(input: {title: "Arrival", year: 2016, runtime: 116, genres: ["drama"]}) { id version } }`, nil)},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusOK,
+			body: graphqlBody(`mutation { updateMovie(id: "99", input: {title: "Missing"}) { id } }`, nil)},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusBadRequest,
+			body: graphqlBody(`{ movie(`, nil)},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusBadRequest,
+			body: graphqlBody(`{ nope }`, nil)},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusBadRequest,
+			body: `{"query": `},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusForbidden,
+			body:  graphqlBody(`mutation { deleteMovie(id: "1") }`, nil),
+			setup: func(app *application, _ *fakeMovieStore) { app.config.tls.clientCAFile = "ca.pem" }},
+		{method: http.MethodPost, target: "/v1/graphql", status: http.StatusUnprocessableEntity,
+			body: `{"query": ""}`},
+	}
+
+	conflict := func(_ *application, movies *fakeMovieStore) { movies.conflict = true }
+	longKey := http.Header{"Idempotency-Key": []string{strings.Repeat("k", 256)}}
+
+	for _, version := range []int{1, 2} {
+		prefix := fmt.Sprintf("/v%d", version)
+		runtime := `"116 mins"`
+		deleted := http.StatusOK
+		if version == 2 {
+			runtime = "116"
+			deleted = http.StatusNoContent
+		}
+		movie := func(title string) string {
+			return fmt.Sprintf(`{"title": %q, "year": 2016, "runtime": %s, "genres": ["drama", "sci-fi"]}`, title, runtime)
+		}
+
+		tests = append(tests, []contractTest{
+			{method: http.MethodGet, target: prefix + "/movies", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies?title=o&genres=adventure&sort=-year&page_size=1", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies?fields=title,year", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies?page=0", status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodPost, target: prefix + "/movies", body: movie("Arrival"), status: http.StatusCreated},
+			{method: http.MethodPost, target: prefix + "/movies", body: movie("Arrival"), status: http.StatusCreated,
+				headers: http.Header{"Idempotency-Key": []string{"create-arrival"}}},
+			{method: http.MethodPost, target: prefix + "/movies", body: `{"title": `, status: http.StatusBadRequest},
+			{method: http.MethodPost, target: prefix + "/movies", body: movie("Moana"), status: http.StatusConflict},
+			{method: http.MethodPost, target: prefix + "/movies", body: movie(""), status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodGet, target: prefix + "/movies/suggest?q=mo", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies/suggest", status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodGet, target: prefix + "/movies/1", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies/1?fields=id,title", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies/99", status: http.StatusNotFound},
+			{method: http.MethodGet, target: prefix + "/movies/1?fields=nope", status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodPatch, target: prefix + "/movies/1", body: `{"title": "Moana 2", "runtime": null}`, status: http.StatusOK},
+			{method: http.MethodPatch, target: prefix + "/movies/1", body: `{"title": `, status: http.StatusBadRequest},
+			{method: http.MethodPatch, target: prefix + "/movies/99", body: `{"title": "Moana 2"}`, status: http.StatusNotFound},
+			{method: http.MethodPatch, target: prefix + "/movies/1", body: `{"title": "Moana 2"}`, status: http.StatusConflict, setup: conflict},
+			{method: http.MethodPatch, target: prefix + "/movies/1", body: `{"year": 1}`, status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodDelete, target: prefix + "/movies/4", status: deleted},
+			{method: http.MethodDelete, target: prefix + "/movies/99", status: http.StatusNotFound},
+
+			{method: http.MethodGet, target: prefix + "/movies/1/similar", status: http.StatusOK},
+			{method: http.MethodGet, target: prefix + "/movies/99/similar", status: http.StatusNotFound},
+			{method: http.MethodGet, target: prefix + "/movies/1/similar?page=0", status: http.StatusUnprocessableEntity},
+
+			{method: http.MethodPost, target: prefix + "/movies/2/merge/3", status: http.StatusOK},
+			{method: http.MethodPost, target: prefix + "/movies/2/merge/3", status: http.StatusBadRequest, headers: longKey},
+			{method: http.MethodPost, target: prefix + "/movies/2/merge/99", status: http.StatusNotFound},
+			{method: http.MethodPost, target: prefix + "/movies/2/merge/3", status: http.StatusConflict, setup: conflict},
+			{method: http.MethodPost, target: prefix + "/movies/2/merge/2", status: http.StatusUnprocessableEntity},
+		}...)
+	}
+	return tests
+}
+
+// graphqlBody returns the JSON request body for a GraphQL query.
+func graphqlBody(query string, variables map[string]any) string {
+	js, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		panic(err)
+	}
+	return string(js)
+}
+
+// TestOpenAPIContract checks that the responses from the handlers match the OpenAPI
+// document. Each request in contractTests() is sent to a fresh application (backed by
+// the fake models), and its response is checked against the document's operation for
+// the route. Once they've all been sent, the test checks that every operation was
+// called, and that every status code it documents was returned at least once, so that
+// a route or response which is added to the document can't go untested.
+func TestOpenAPIContract(t *testing.T) {
+	seen := make(map[string]map[string]bool)
+
+	for _, tt := range contractTests() {
+		name := fmt.Sprintf("%s %s %d", tt.method, tt.target, tt.status)
+		t.Run(name, func(t *testing.T) {
+			app, movies := newTestApplication(t)
+			if tt.setup != nil {
+				tt.setup(app, movies)
+			}
+			headers := tt.headers
+			if tt.body != "" {
+				headers = headers.Clone()
+				if headers == nil {
+					headers = http.Header{}
+				}
+				headers.Set("Content-Type", "application/json")
+			}
+
+			res := send(t, app.routes(), tt.method, tt.target, tt.body, headers)
+			if res.status != tt.status {
+				t.Fatalf("got status %d; want %d; body: %s", res.status, tt.status, res.body)
+			}
+
+			u, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			op, _ := openAPIDocument.Find(tt.method, u.Path)
+			if op == nil {
+				t.Fatalf("no operation in the OpenAPI document for %s %s", tt.method, u.Path)
+			}
+			for _, problem := range op.ResponseErrors(res.status, res.header.Get("Content-Type"), res.body) {
+				t.Errorf("response doesn't match the OpenAPI document: %s", problem)
+			}
+
+			key := op.Method + " " + op.Path
+			if seen[key] == nil {
+				seen[key] = make(map[string]bool)
+			}
+			seen[key][strconv.Itoa(res.status)] = true
+		})
+	}
+
+	for _, op := range openAPIDocument.Operations() {
+		key := op.Method + " " + op.Path
+		for _, status := range documentedStatuses(t, op.Method, op.Path) {
+			if !seen[key][status] {
+				t.Errorf("%s: documented status %s is never returned by the contract tests", key, status)
+			}
+		}
+	}
+}
+
+// documentedStatuses returns the status codes which are documented for an operation,
+// apart from the default response.
+func documentedStatuses(t *testing.T, method, path string) []string {
+	t.Helper()
+
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(openAPIJSON, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var operation struct {
+		Responses map[string]any `json:"responses"`
+	}
+	err = json.Unmarshal(doc.Paths[path][strings.ToLower(method)], &operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []string
+	for status := range operation.Responses {
+		if status != "default" {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,53 @@
+package main
+
+import "fmt"
+
+// Define the profile for each environment. A profile is a set of default values for
+// settings, keyed by setting name, which replace the flag defaults in that environment.
+// They only change the default: a setting given in the config file, an environment
+// variable or a flag always wins (see configLoader.applyProfile()). The staging
+// environment, which is the default, uses the flag defaults as they are.
+//
+//   - In development we send the details of server errors to clients (including a
+//     debug error page for browsers), log every SQL statement and check requests and
+//     responses against the OpenAPI document.
+//   - In production we send compact responses, never send stack traces to clients,
+//     use shorter server timeouts and refuse to start without TLS.
+var profiles = map[string]map[string]string{
+	"development": {
+		"pretty-responses": "true",
+		"debug-errors":     "true",
+		"log-sql":          "true",
+		// Check requests and responses against the OpenAPI document, so that any
+		// drift between the handlers and the document shows up in the log.
+		"openapi-validation": "all",
+	},
+	"staging": {},
+	"production": {
+		"pretty-responses":     "false",
+		"debug-errors":         "false",
+		"log-sql":              "false",
+		"tls-required":         "true",
+		"server-idle-timeout":  "30s",
+		"server-read-timeout":  "5s",
+		"server-write-timeout": "10s",
+	},
+}
+
+// The applyProfile() method sets the settings in the profile for the configured
+// environment, except for those which were given explicitly in one of the other
+// sources. Their source is recorded as the profile, so that "config print" shows where
+// the value came from. An unknown environment has no profile; validate() reports it.
+func (cl *configLoader) applyProfile() error {
+	for name, value := range profiles[cl.cfg.env] {
+		if cl.sources[name] != "default" {
+			continue
+		}
+		err := cl.fs.Lookup(name).Value.Set(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s in the %s profile: %w", value, name, cl.cfg.env, err)
+		}
+		cl.sources[name] = cl.cfg.env + " profile"
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The renderFormat type describes one of the formats that responses can be rendered
+// in. The contentType is sent in the Content-Type header of the response, and
+// mediaTypes lists the media types in the Accept header which select the format.
+type renderFormat struct {
+	contentType string
+	mediaTypes  []string
+}
+
+// Define the formats which responses can be rendered in, in order of preference for
+// when a client accepts more than one of them equally. Note that CSV can only be used
+// for responses containing a list of records (see encodeCSV()).
+var (
+	formatJSON    = renderFormat{"application/json", []string{"application/json"}}
+	formatXML     = renderFormat{"application/xml", []string{"application/xml", "text/xml"}}
+	formatCSV     = renderFormat{"text/csv", []string{"text/csv"}}
+	formatMsgpack = renderFormat{"application/msgpack", []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}}
+
+	renderFormats = []renderFormat{formatJSON, formatXML, formatCSV, formatMsgpack}
+
+	// listFormats are the formats that routes which respond with a list of records can
+	// be rendered in, and recordFormats those for every other route, which can't be
+	// sent as CSV. They're passed to requireAcceptable() when the routes are registered.
+	listFormats   = renderFormats
+	recordFormats = []renderFormat{formatJSON, formatXML, formatMsgpack}
+)
+
+// The render() helper sends a response containing the data in the envelope, in the
+// format which best matches the request's Accept header. Every format is produced from
+// the JSON encoding of the envelope, so that the structure of the response and the
+// encoding of the values in it (like the "<runtime> mins" form of a movie's runtime)
+// are the same whichever format is used.
+//
+// If none of the formats that the client accepts can be used for the response, we send
+// a 406 Not Acceptable response instead. The exception is error responses, which are
+// sent as JSON in that case, so that the client still finds out what went wrong.
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	body, format, err := app.encodeResponse(r, status, js)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		if status < 400 {
+			app.notAcceptableResponse(w, r)
+			return nil
+		}
+		body, err = encodeJSON(js, app.pretty(r))
+		if err != nil {
+			return err
+		}
+		format = formatJSON
+	}
+
+	// At this point, we know that we won't encounter any more errors before writing the
+	// response, so it's safe to add any headers that we want to include. We loop
+	// through the header map and add each header to the http.ResponseWriter header map.
+	// Note that it's OK if the provided header map is nil. Go doesn't throw an error
+	// if you try to range over (or generally, read from) a nil map.
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	// The format of the response depends on the Accept header, so caches need to know
+	// to take it into account.
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", format.contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// The encodeResponse() method encodes the JSON for a response in the best of the
+// formats that the client accepts. It returns a nil body if none of them can be used.
+func (app *application) encodeResponse(r *http.Request, status int, js []byte) ([]byte, renderFormat, error) {
+	var tree any
+	for _, format := range acceptableFormats(r.Header.Get("Accept")) {
+		if format.contentType == formatJSON.contentType {
+			body, err := encodeJSON(js, app.pretty(r))
+			return body, format, err
+		}
+
+		// The other formats are encoded from the decoded JSON.
+		if tree == nil {
+			var err error
+			tree, err = decodeTree(js)
+			if err != nil {
+				return nil, format, err
+			}
+		}
+
+		switch format.contentType {
+		case formatXML.contentType:
+			body, err := encodeXML(tree, app.pretty(r))
+			return body, format, err
+		case formatCSV.contentType:
+			// Error responses aren't lists of records, even when they contain one (like
+			// the list of duplicates in duplicateMovieResponse()), so they are never
+			// sent as CSV.
+			if status >= 400 {
+				continue
+			}
+			body, ok, err := encodeCSV(tree)
+			if err != nil || ok {
+				return body, format, err
+			}
+		case formatMsgpack.contentType:
+			body, err := encodeMsgpack(tree)
+			return body, format, err
+		}
+	}
+	return nil, renderFormat{}, nil
+}
+
+// The acceptableFormats() function returns the formats which are acceptable according
+// to the value of an Accept header, best first. Each format gets the quality value of
+// the most specific media range that matches it (so "text/csv" beats "text/*", which
+// beats "*/*"), and formats with the same quality value are kept in our order of
+// preference. A missing Accept header means that every format is acceptable.
+func acceptableFormats(header string) []renderFormat {
+	if strings.TrimSpace(header) == "" {
+		return renderFormats
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.TrimSpace(name) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	type candidate struct {
+		format renderFormat
+		q      float64
+	}
+	var candidates []candidate
+	for _, format := range renderFormats {
+		q, specificity := 0.0, 0
+		for _, mr := range ranges {
+			for _, mediaType := range format.mediaTypes {
+				s := 0
+				switch {
+				case mr.mediaType == mediaType:
+					s = 3
+				case mr.mediaType == mediaType[:strings.Index(mediaType, "/")]+"/*":
+					s = 2
+				case mr.mediaType == "*/*":
+					s = 1
+				}
+				if s > specificity {
+					q, specificity = mr.q, s
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{format, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	formats := make([]renderFormat, len(candidates))
+	for i, c := range candidates {
+		formats[i] = c.format
+	}
+	return formats
+}
+
+// The requireAcceptable() middleware sends a 406 Not Acceptable response straight away
+// if the client doesn't accept any of the formats that the route can render its
+// responses in (either listFormats or recordFormats), so that requests which would fail
+// anyway don't go on to make changes to the database. It's important that CSV is only
+// allowed for routes which respond with a list, as render() can't tell that a response
+// isn't a list until after the handler has run.
+func (app *application) requireAcceptable(formats []renderFormat, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, format := range acceptableFormats(r.Header.Get("Accept")) {
+			if slices.ContainsFunc(formats, func(f renderFormat) bool { return f.contentType == format.contentType }) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		app.notAcceptableResponse(w, r)
+	}
+}
+
+// encodeJSON returns the JSON with a trailing newline (to make it easier to view in
+// terminal applications), indenting it with tabs first if pretty is true.
+func encodeJSON(js []byte, pretty bool) ([]byte, error) {
+	if !pretty {
+		return append(js, '\n'), nil
+	}
+	var buf bytes.Buffer
+	err := json.Indent(&buf, js, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// The orderedMap type holds a decoded JSON object. Unlike a map, it keeps the fields in
+// the order they were encoded in, so that the other formats list them in the same order
+// as the JSON does.
+type orderedMap []orderedField
+
+type orderedField struct {
+	key   string
+	value any
+}
+
+// MarshalJSON() encodes the orderedMap as a JSON object, keeping the order of the
+// fields.
+func (m orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeTree decodes JSON into an orderedMap, []any, string, json.Number, bool or nil
+// value. Numbers are kept as json.Number so that they are written out exactly as they
+// appear in the JSON.
+func decodeTree(js []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return decodeTreeValue(dec)
+}
+
+func decodeTreeValue(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		m := orderedMap{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeTreeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, orderedField{key.(string), value})
+		}
+		_, err = dec.Token()
+		return m, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := decodeTreeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	default:
+		return token, nil
+	}
+}
+
+// scalarString returns the text form of a decoded JSON string, number, boolean or null.
+func scalarString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		js, _ := json.Marshal(v)
+		return string(js)
+	}
+}
+
+// xmlNameRX matches the JSON field names which can be used as XML element names as
+// they are.
+var xmlNameRX = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// encodeXML encodes a decoded JSON value as an XML document with a <response> root
+// element. Object fields become child elements named after the field (or <entry>
+// elements with a key attribute, if the field name isn't a valid element name), and
+// the values in a list become <item> elements.
+func encodeXML(tree any, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if pretty {
+		enc.Indent("", "\t")
+	}
+	err := encodeXMLElement(enc, "response", tree)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Flush()
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func encodeXMLElement(enc *xml.Encoder, name string, value any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !xmlNameRX.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case orderedMap:
+		for _, field := range v {
+			err = encodeXMLElement(enc, field.key, field.value)
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range v {
+			err = encodeXMLElement(enc, "item", item)
+			if err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		err = enc.EncodeToken(xml.CharData(scalarString(v)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// encodeCSV encodes a decoded JSON value as CSV, if it's an object containing exactly
+// one list of records (like the "movies" list in the response from GET /v1/movies).
+// Anything else in the object, like the pagination metadata, is left out; clients can
+// use the Link header to page through CSV listings instead. Nested objects are
+// flattened into columns with dotted names (like "_links.self"), and lists of values
+// are joined with semicolons. The bool result is false if the value isn't a list.
+func encodeCSV(tree any) ([]byte, bool, error) {
+	root, ok := tree.(orderedMap)
+	if !ok {
+		return nil, false, nil
+	}
+	var records []any
+	lists := 0
+	for _, field := range root {
+		if list, ok := field.value.([]any); ok {
+			records = list
+			lists++
+		}
+	}
+	if lists != 1 {
+		return nil, false, nil
+	}
+
+	var columns []string
+	rows := make([]map[string]string, len(records))
+	for i, record := range records {
+		if _, ok := record.(orderedMap); !ok {
+			return nil, false, nil
+		}
+		rows[i] = make(map[string]string)
+		flattenCSV("", record, rows[i], &columns)
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if len(columns) > 0 {
+		cw.Write(columns)
+	}
+	for _, row := range rows {
+		line := make([]string, len(columns))
+		for i, column := range columns {
+			line[i] = row[column]
+		}
+		cw.Write(line)
+	}
+	cw.Flush()
+	return buf.Bytes(), true, cw.Error()
+}
+
+func flattenCSV(prefix string, value any, row map[string]string, columns *[]string) {
+	switch v := value.(type) {
+	case orderedMap:
+		for _, field := range v {
+			key := field.key
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenCSV(key, field.value, row, columns)
+		}
+		return
+	case []any:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = scalarString(item)
+		}
+		row[prefix] = strings.Join(values, ";")
+	default:
+		row[prefix] = scalarString(v)
+	}
+	for _, column := range *columns {
+		if column == prefix {
+			return
+		}
+	}
+	*columns = append(*columns, prefix)
+}
+
+// encodeMsgpack encodes a decoded JSON value as MessagePack. Numbers are encoded as
+// integers where possible, and as floats otherwise.
+func encodeMsgpack(tree any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	err := encodeMsgpackValue(enc, tree)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeMsgpackValue(enc *msgpack.Encoder, value any) error {
+	switch v := value.(type) {
+	case orderedMap:
+		err := enc.EncodeMapLen(len(v))
+		if err != nil {
+			return err
+		}
+		for _, field := range v {
+			err = enc.EncodeString(field.key)
+			if err != nil {
+				return err
+			}
+			err = encodeMsgpackValue(enc, field.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		err := enc.EncodeArrayLen(len(v))
+		if err != nil {
+			return err
+		}
+		for _, item := range v {
+			err = encodeMsgpackValue(enc, item)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return enc.EncodeInt(i)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	case string:
+		return enc.EncodeString(v)
+	case bool:
+		return enc.EncodeBool(v)
+	default:
+		return enc.EncodeNil()
+	}
+}
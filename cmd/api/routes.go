@@ -1,24 +1,124 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-func (app *application) routes() *httprouter.Router { // Initialize a new httprouter router instance.
+// Update the routes() method to return a http.Handler instead of a *httprouter.Router.
+func (app *application) routes() http.Handler { // Initialize a new httprouter router instance.
 	router := httprouter.New()
+	// Every route is wrapped in the rate limiter, which is given the route's method and
+	// path so that any per-route override in the config is applied to it.
+	limit := app.rateLimit()
 	// Convert the notFoundResponse() helper and methodNotAllowedResponse()
 	// helper to a http.Handler using the http.HandlerFunc() adapter
+	router.NotFound = limit("", app.notFoundResponse)
+	router.MethodNotAllowed = limit("", app.methodNotAllowedResponse)
+	// httprouter answers OPTIONS requests automatically, setting the Allow header to
+	// the methods registered for the path, before calling GlobalOPTIONS. We use this to
+	// respond to CORS preflight requests with the allowed methods for each route.
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflightHandler)
+
+	// The handle() function registers a handler with the router, wrapped in the rate
+	// limiter for the route and in a latency histogram for the route's metrics. Inside
+	// the rate limiter, the handler is wrapped in the OpenAPI validation middleware (so
+	// that the requests it rejects still count against the limit), and then in the
+	// requireAcceptable() middleware, so that requests which don't accept any of the
+	// formats the route can respond in are turned away up front. Only routes which
+	// respond with a list can use listFormats (which include CSV); every other route
+	// uses recordFormats. Every route is added to the registered slice, so that we can
+	// check that the OpenAPI document describes the same routes (see
+	// checkOpenAPIRoutes()).
+	var registered []string
+	wrap := func(route string, formats []renderFormat, handler http.HandlerFunc) http.HandlerFunc {
+		return app.observeLatency(route, limit(route, app.validateOpenAPI(app.requireAcceptable(formats, handler))))
+	}
+	handle := func(method, path string, formats []renderFormat, handler http.HandlerFunc) {
+		route := method + " " + path
+		registered = append(registered, route)
+		router.HandlerFunc(method, path, wrap(route, formats, handler))
+	}
+
+	handle(http.MethodGet, "/v1/healthcheck", recordFormats, app.healthcheckHandler)
+	// The liveness and readiness checks are polled by the orchestrator, so they aren't
+	// rate limited, or we could end up being taken out of service for being checked
+	// on too often.
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/live", app.validateOpenAPI(app.livenessHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck/ready", app.validateOpenAPI(app.readinessHandler))
+	registered = append(registered, "GET /v1/healthcheck/live", "GET /v1/healthcheck/ready")
+	handle(http.MethodGet, "/v1/openapi.json", recordFormats, app.openAPIHandler)
+
+	// The movie endpoints are served under both /v1 and /v2 by the same handlers,
+	// which work out the version from the path (see apiVersion()). Each version's
+	// routes are rate limited and measured separately. The routes which change movies
+	// require a TLS client certificate, when they're enabled (see requirePrincipal()).
+	for _, prefix := range []string{"/v1", "/v2"} {
+		handle(http.MethodGet, prefix+"/movies", listFormats, app.listMoviesHandler)
+		handle(http.MethodPost, prefix+"/movies", recordFormats, app.requirePrincipal(app.idempotent(app.createMovieHandler)))
+		// GET /movies/suggest is dispatched from the :id route (see staticIDParam()),
+		// so we wrap its two handlers in the middleware separately.
+		suggest, show := "GET "+prefix+"/movies/suggest", "GET "+prefix+"/movies/:id"
+		router.HandlerFunc(http.MethodGet, prefix+"/movies/:id", app.staticIDParam("suggest",
+			wrap(suggest, listFormats, app.suggestMoviesHandler),
+			wrap(show, recordFormats, app.showMovieHandler)))
+		registered = append(registered, suggest, show)
+		handle(http.MethodGet, prefix+"/movies/:id/similar", listFormats, app.listSimilarMoviesHandler)
+		handle(http.MethodPost, prefix+"/movies/:id/merge/:other_id", recordFormats, app.requirePrincipal(app.idempotent(app.mergeMoviesHandler)))
+		handle(http.MethodPatch, prefix+"/movies/:id", recordFormats, app.requirePrincipal(app.updateMovieHandler))
+		handle(http.MethodDelete, prefix+"/movies/:id", recordFormats, app.requirePrincipal(app.deleteMovieHandler))
+	}
+
+	// The GraphQL endpoint serves the same movies as the REST endpoints, but lets
+	// clients choose the shape of the response, following related movies in a single
+	// request (see graphqlSchema()).
+	handle(http.MethodPost, "/v1/graphql", recordFormats, app.graphqlHandler())
+
+	// Unless the metrics endpoints have their own admin listener (see adminRoutes()),
+	// serve them here. They aren't rate limited, so that scrapers are never turned away.
+	if app.config.metrics.addr == "" {
+		app.metricsRoutes(router)
+	}
+	// The metrics endpoints are documented wherever they are served, so they always
+	// count as registered.
+	registered = append(registered, "GET /debug/vars", "GET /metrics")
+
+	// A mismatch between the routes and the OpenAPI document is a programming error,
+	// so we panic, in the same way as the router does for conflicting routes.
+	err := checkOpenAPIRoutes(registered)
+	if err != nil {
+		panic(err)
+	}
+
+	// Wrap the router with the CORS middleware, then with the compression middleware
+	// and the panic recovery middleware, and that with the metrics and access logging
+	// middleware so that requests which panic are counted and logged too (and so that
+	// the number of bytes logged is the number actually sent). The request ID
+	// middleware goes on the outside, so that the ID is available to everything else.
+	// The client certificate authentication middleware goes just inside it, so that
+	// the principal is available to everything else too. The v1 deprecation headers
+	// are added just outside the router, so that they're sent with every response
+	// from the v1 routes, including the errors from the OpenAPI validation middleware.
+	return app.assignRequestID(app.authenticateClientCert(app.logRequest(app.recordMetrics(app.recoverPanic(app.compress(app.enableCORS(app.deprecateV1(router))))))))
+}
+
+// The adminRoutes() method returns the handler for the admin listener, which serves
+// the metrics endpoints when the -metrics-addr flag is set.
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+	app.metricsRoutes(router)
+
+	return app.assignRequestID(app.recoverPanic(router))
+}
 
-	return router
+// The metricsRoutes() method registers the metrics endpoints with the router: the
+// expvar JSON output at /debug/vars, and the Prometheus text format at /metrics.
+func (app *application) metricsRoutes(router *httprouter.Router) {
+	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodGet, "/metrics", app.prometheusHandler)
 }
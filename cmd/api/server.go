@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func (app *application) serve() error {
+	// Declare a HTTP server using the same settings as in our main() function, with
+	// the timeouts from the config (which are shorter in production).
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.routes(),
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+		// Send any errors logged by the server itself through our structured logger.
+		ErrorLog: slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+
+	// Set up TLS, if it's enabled.
+	tlsConfig, err := app.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tlsConfig
+
+	// If the metrics endpoints have their own admin listener, start serving it in the
+	// background. We open the listener here, rather than in the goroutine, so that a
+	// bad address stops the application from starting.
+	var admin *http.Server
+	if app.config.metrics.addr != "" {
+		admin = &http.Server{
+			Addr:         app.config.metrics.addr,
+			Handler:      app.adminRoutes(),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		}
+		ln, err := net.Listen("tcp", admin.Addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			app.logger.Info("starting admin server", "addr", admin.Addr)
+			err := admin.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error(err.Error(), "addr", admin.Addr)
+			}
+		}()
+	}
+
+	// Start purging the expired idempotency keys in the background. The stop channel
+	// is closed when we shut down, before waiting for the background tasks to finish.
+	stopPurge := make(chan struct{})
+	app.background(func() { app.purgeIdempotencyKeys(stopPurge) })
+
+	// Create a shutdownError channel. We will use this to receive any errors returned
+	// by the graceful Shutdown() function.
+	shutdownError := make(chan error)
+
+	// Start a background goroutine.
+	go func() {
+		// Create a quit channel which carries os.Signal values.
+		quit := make(chan os.Signal, 1)
+		// Use signal.Notify() to listen for incoming SIGINT and SIGTERM signals and
+		// relay them to the quit channel. Any other signals will not be caught by
+		// signal.Notify() and will retain their default behavior.
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		// Read the signal from the quit channel. This code will block until a signal is
+		// received.
+		s := <-quit
+		// Log a message to say that the signal has been caught.
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		// Start reporting that we're draining in the readiness check, and carry on
+		// serving requests for the configured delay, so that load balancers have time
+		// to notice and take us out of rotation before we stop accepting connections.
+		app.draining.Store(true)
+		if app.config.shutdownDelay > 0 {
+			app.logger.Info("draining requests", "delay", app.config.shutdownDelay.String())
+			time.Sleep(app.config.shutdownDelay)
+		}
+
+		// Create a context with the configured grace period as its timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		// Call Shutdown() on the server, which stops accepting new connections and
+		// waits for in-flight requests to complete. If it returns an error (because
+		// the grace period ran out, say), we hold on to it until the background tasks
+		// have finished, as they still need to complete either way.
+		err := srv.Shutdown(ctx)
+
+		// Shut down the admin server too, if there is one. Its errors are only logged,
+		// as there's nothing in flight on it that clients depend on.
+		if admin != nil {
+			err := admin.Shutdown(ctx)
+			if err != nil {
+				app.logger.Error(err.Error(), "addr", admin.Addr)
+			}
+		}
+
+		// Stop purging idempotency keys, and log a message to say that we're waiting
+		// for any background goroutines to complete their tasks.
+		close(stopPurge)
+		app.logger.Info("completing background tasks", "addr", srv.Addr)
+
+		// Call Wait() to block until our WaitGroup counter is zero --- essentially
+		// blocking until the background goroutines have finished. Then we send the
+		// result of Shutdown() on the shutdownError channel, which is nil if the
+		// shutdown completed without any issues.
+		app.wg.Wait()
+		app.logger.Info("background tasks completed")
+		shutdownError <- err
+	}()
+
+	// Likewise log a "starting server" message.
+	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env, "tls", tlsConfig != nil)
+
+	// Calling Shutdown() on our server will cause ListenAndServe() to immediately
+	// return a http.ErrServerClosed error. So if we see this error, it is actually a
+	// good thing and an indication that the graceful shutdown has started. So we check
+	// specifically for this, only returning the error if it is NOT http.ErrServerClosed.
+	// When TLS is enabled we use ListenAndServeTLS() instead. The certificate comes from
+	// the GetCertificate function in the TLS config, so we don't pass any files to it.
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	// Otherwise, we wait to receive the return value from Shutdown() on the
+	// shutdownError channel. If return value is an error, we know that there was a
+	// problem with the graceful shutdown and we return the error.
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	// At this point we know that the graceful shutdown completed successfully and we
+	// log a "stopped server" message.
+	app.logger.Info("stopped server", "addr", srv.Addr)
+	return nil
+}
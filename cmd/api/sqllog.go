@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// The sqlLogger type is a driver.Connector which wraps the connector for the real
+// database driver, and logs every SQL statement run on its connections along with how
+// long it took and any error. It's enabled by the -log-sql setting (which is on in the
+// development profile), and used by openDB() in place of the driver's own connector.
+// The arguments to the statements aren't logged, as they can include things like
+// password hashes.
+type sqlLogger struct {
+	connector driver.Connector
+	logger    *slog.Logger
+}
+
+func (sl sqlLogger) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := sl.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggedConn{Conn: conn, logger: sl.logger}, nil
+}
+
+func (sl sqlLogger) Driver() driver.Driver {
+	return sl.connector.Driver()
+}
+
+// The loggedConn type wraps a driver connection. As well as logging the statements, it
+// has to pass on each of the optional driver interfaces that the database/sql package
+// looks for, so that wrapping the connection doesn't change how it behaves. Where the
+// wrapped connection doesn't implement one, we return driver.ErrSkip, which tells the
+// database/sql package to fall back to its default behavior.
+type loggedConn struct {
+	driver.Conn
+	logger *slog.Logger
+}
+
+// The log() method logs a statement. The whitespace in the query is collapsed, so that
+// the multi-line queries in the data package fit on one line of the log.
+func (c *loggedConn) log(ctx context.Context, query string, args int, start time.Time, err error) {
+	attrs := []any{
+		"query", strings.Join(strings.Fields(query), " "),
+		"args", args,
+		"duration", time.Since(start).String(),
+	}
+	if err != nil && err != driver.ErrSkip {
+		attrs = append(attrs, "error", err.Error())
+	}
+	c.logger.InfoContext(ctx, "sql", attrs...)
+}
+
+func (c *loggedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.log(ctx, query, len(args), start, err)
+	return rows, err
+}
+
+func (c *loggedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.log(ctx, query, len(args), start, err)
+	return result, err
+}
+
+// Prepared statements are logged when they are prepared, rather than each time they
+// are run.
+func (c *loggedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	c.log(ctx, "PREPARE "+query, 0, start, err)
+	return stmt, err
+}
+
+func (c *loggedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *loggedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *loggedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *loggedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *loggedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"GoFurtherWebPractice/internal/recommender"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestApplication returns an application with the default configuration, backed by
+// in-memory fakes of the models (see fakeMovieStore) rather than a real database. The
+// movie store is seeded with a few movies, and returned too so that tests can inspect
+// and change it.
+func newTestApplication(t *testing.T) (*application, *fakeMovieStore) {
+	t.Helper()
+
+	var cfg config
+	newFlagSet(&cfg)
+	cfg.limiter.enabled = false
+
+	movies := newFakeMovieStore()
+	app := &application{
+		config: cfg,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		db:     sql.OpenDB(fakeConnector{}),
+		models: data.Models{
+			Movies:          movies,
+			IdempotencyKeys: newFakeIdempotencyKeyStore(),
+			Schema:          fakeSchemaStore{},
+		},
+		metrics: newMetrics(),
+		similar: recommender.NewWeightedScorer(recommender.Weights{
+			Genres:  cfg.similar.genresWeight,
+			Year:    cfg.similar.yearWeight,
+			Runtime: cfg.similar.runtimeWeight,
+		}),
+	}
+	t.Cleanup(func() { app.db.Close() })
+	return app, movies
+}
+
+// The testResponse type holds the parts of a response that tests look at.
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// send sends a request to the handler, and returns the response.
+func send(t *testing.T, h http.Handler, method, target, body string, headers http.Header) testResponse {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	for name, values := range headers {
+		r.Header[name] = values
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return testResponse{status: rr.Code, header: rr.Header(), body: rr.Body.Bytes()}
+}
+
+// The fakeConnector type is a database/sql connector whose connections can do nothing
+// but be pinged, which is all that the readiness check does with the connection pool.
+// Everything else goes through the fake models.
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("fake database") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("fake database") }
+
+// The fakeMovieStore type is an in-memory implementation of data.MovieStore. It keeps
+// to the contract of MovieModel closely enough for the handlers (versions, edit
+// conflicts, not found errors and so on), but doesn't try to match its filtering,
+// sorting or scoring exactly. Setting conflict makes every change fail with
+// data.ErrEditConflict, as if another client had changed the movie first.
+type fakeMovieStore struct {
+	mu         sync.Mutex
+	movies     map[int64]*data.Movie
+	popularity map[int64]int
+	nextID     int64
+	conflict   bool
+}
+
+func newFakeMovieStore() *fakeMovieStore {
+	s := &fakeMovieStore{movies: make(map[int64]*data.Movie), popularity: make(map[int64]int), nextID: 1}
+	for _, movie := range []*data.Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 96, Genres: []string{"drama"}},
+	} {
+		s.Insert(movie)
+	}
+	return s
+}
+
+// sorted returns the movies ordered by ID. The caller must hold the lock.
+func (s *fakeMovieStore) sorted() []*data.Movie {
+	movies := make([]*data.Movie, 0, len(s.movies))
+	for _, movie := range s.movies {
+		movies = append(movies, movie)
+	}
+	slices.SortFunc(movies, func(a, b *data.Movie) int { return int(a.ID - b.ID) })
+	return movies
+}
+
+// copyMovie returns a copy of a stored movie, so that handlers can't change the store
+// without going through it.
+func copyMovie(movie *data.Movie) *data.Movie {
+	c := *movie
+	c.Genres = slices.Clone(movie.Genres)
+	return &c
+}
+
+func (s *fakeMovieStore) WithRequestID(string) data.MovieStore {
+	return s
+}
+
+func (s *fakeMovieStore) Insert(movie *data.Movie) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie.ID = s.nextID
+	movie.CreatedAt = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	movie.UpdatedAt = movie.CreatedAt
+	movie.Version = 1
+	s.movies[movie.ID] = copyMovie(movie)
+	s.nextID++
+	return nil
+}
+
+func (s *fakeMovieStore) Get(id int64) (*data.Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movie, ok := s.movies[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	return copyMovie(movie), nil
+}
+
+func (s *fakeMovieStore) GetFields(id int64, fields data.FieldSet) (*data.Movie, error) {
+	return s.Get(id)
+}
+
+func (s *fakeMovieStore) Update(movie *data.Movie) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.movies[movie.ID]
+	if !ok || s.conflict || stored.Version != movie.Version {
+		return data.ErrEditConflict
+	}
+	movie.Version++
+	movie.UpdatedAt = movie.UpdatedAt.Add(time.Hour)
+	s.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (s *fakeMovieStore) Delete(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.movies[id]; !ok {
+		return data.ErrRecordNotFound
+	}
+	delete(s.movies, id)
+	return nil
+}
+
+func (s *fakeMovieStore) GetAll(title string, genres []string, filters data.Filters, fields data.FieldSet) ([]*data.Movie, data.Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []*data.Movie
+	for _, movie := range s.sorted() {
+		if !strings.Contains(strings.ToLower(movie.Title), strings.ToLower(title)) {
+			continue
+		}
+		if !slices.ContainsFunc(genres, func(genre string) bool { return !slices.Contains(movie.Genres, genre) }) {
+			matches = append(matches, copyMovie(movie))
+		}
+	}
+	start, end, metadata := filters.PageBounds(len(matches))
+	return append([]*data.Movie{}, matches[start:end]...), metadata, nil
+}
+
+func (s *fakeMovieStore) Suggest(prefix string, limit int) ([]*data.MovieSuggestion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movies := s.sorted()
+	slices.SortStableFunc(movies, func(a, b *data.Movie) int { return s.popularity[b.ID] - s.popularity[a.ID] })
+
+	suggestions := []*data.MovieSuggestion{}
+	for _, movie := range movies {
+		if len(suggestions) < limit && strings.HasPrefix(strings.ToLower(movie.Title), strings.ToLower(prefix)) {
+			suggestions = append(suggestions, &data.MovieSuggestion{ID: movie.ID, Title: movie.Title, Year: movie.Year})
+		}
+	}
+	return suggestions, nil
+}
+
+func (s *fakeMovieStore) IncrementPopularity(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.popularity[id]++
+	return nil
+}
+
+func (s *fakeMovieStore) GetSimilarCandidates(movie *data.Movie, limit int) ([]*data.Movie, error) {
+	candidates, err := s.GetSimilarCandidatesForMany([]int64{movie.ID}, limit)
+	return candidates[movie.ID], err
+}
+
+func (s *fakeMovieStore) GetSimilarCandidatesForMany(ids []int64, limit int) (map[int64][]*data.Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := make(map[int64][]*data.Movie, len(ids))
+	for _, id := range ids {
+		candidates[id] = []*data.Movie{}
+		target, ok := s.movies[id]
+		if !ok {
+			continue
+		}
+		for _, movie := range s.sorted() {
+			if movie.ID != id && len(candidates[id]) < limit && recommender.Jaccard(target.Genres, movie.Genres) > 0 {
+				candidates[id] = append(candidates[id], copyMovie(movie))
+			}
+		}
+	}
+	return candidates, nil
+}
+
+func (s *fakeMovieStore) FindDuplicates(movie *data.Movie, threshold float64) ([]*data.Duplicate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	duplicates := []*data.Duplicate{}
+	for _, existing := range s.sorted() {
+		if existing.ID != movie.ID && strings.EqualFold(existing.Title, movie.Title) {
+			duplicates = append(duplicates, &data.Duplicate{Movie: copyMovie(existing), Similarity: 1, Exact: true})
+		}
+	}
+	return duplicates, nil
+}
+
+func (s *fakeMovieStore) Merge(canonical, duplicate *data.Movie, genres []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.movies[canonical.ID]
+	if !ok || s.conflict || stored.Version != canonical.Version {
+		return data.ErrEditConflict
+	}
+	if _, ok := s.movies[duplicate.ID]; !ok {
+		return data.ErrEditConflict
+	}
+	canonical.Genres = genres
+	canonical.Version++
+	s.movies[canonical.ID] = copyMovie(canonical)
+	delete(s.movies, duplicate.ID)
+	return nil
+}
+
+func (s *fakeMovieStore) GetGenres() ([]*data.Genre, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, movie := range s.movies {
+		for _, genre := range movie.Genres {
+			counts[genre]++
+		}
+	}
+	genres := []*data.Genre{}
+	for name, count := range counts {
+		genres = append(genres, &data.Genre{Name: name, Movies: count})
+	}
+	slices.SortFunc(genres, func(a, b *data.Genre) int { return strings.Compare(a.Name, b.Name) })
+	return genres, nil
+}
+
+func (s *fakeMovieStore) GetForGenres(genres []string, limit int) (map[string][]*data.Movie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	movies := make(map[string][]*data.Movie, len(genres))
+	for _, genre := range genres {
+		movies[genre] = []*data.Movie{}
+		for _, movie := range s.sorted() {
+			if len(movies[genre]) < limit && slices.Contains(movie.Genres, genre) {
+				movies[genre] = append(movies[genre], copyMovie(movie))
+			}
+		}
+	}
+	return movies, nil
+}
+
+// The fakeIdempotencyKeyStore type is an in-memory implementation of
+// data.IdempotencyKeyStore. Reservations never expire.
+type fakeIdempotencyKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*fakeIdempotencyKey
+}
+
+type fakeIdempotencyKey struct {
+	reservation data.IdempotencyReservation
+	response    *data.IdempotentResponse
+}
+
+func newFakeIdempotencyKeyStore() *fakeIdempotencyKeyStore {
+	return &fakeIdempotencyKeyStore{keys: make(map[string]*fakeIdempotencyKey)}
+}
+
+func (s *fakeIdempotencyKeyStore) Reserve(key, requestHash string, ttl, lease time.Duration) (*data.IdempotencyReservation, *data.IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.keys[key]
+	switch {
+	case !ok:
+		reservation := data.IdempotencyReservation{Key: key, RequestHash: requestHash, ReservedAt: time.Now()}
+		s.keys[key] = &fakeIdempotencyKey{reservation: reservation}
+		return &reservation, nil, nil
+	case existing.reservation.RequestHash != requestHash:
+		return nil, nil, data.ErrIdempotencyKeyMismatch
+	case existing.response == nil:
+		return nil, nil, data.ErrIdempotencyKeyInFlight
+	}
+	return nil, existing.response, nil
+}
+
+func (s *fakeIdempotencyKeyStore) Complete(reservation *data.IdempotencyReservation, response *data.IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.keys[reservation.Key]; ok && existing.reservation == *reservation && existing.response == nil {
+		existing.response = response
+	}
+	return nil
+}
+
+func (s *fakeIdempotencyKeyStore) Release(reservation *data.IdempotencyReservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.keys[reservation.Key]; ok && existing.reservation == *reservation && existing.response == nil {
+		delete(s.keys, reservation.Key)
+	}
+	return nil
+}
+
+func (s *fakeIdempotencyKeyStore) DeleteExpired() (int64, error) {
+	return 0, nil
+}
+
+// The fakeSchemaStore type reports that the database is at the expected schema version.
+type fakeSchemaStore struct{}
+
+func (fakeSchemaStore) Version(context.Context) (int64, bool, error) {
+	return data.SchemaVersion, false, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// The certReloader type holds the server's TLS certificate, and reloads it from the
+// certificate and key files whenever the process receives a SIGHUP signal. This means
+// that renewed certificates can be picked up without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// The newCertReloader() function loads the certificate and key from the given files
+// and returns a certReloader for them.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// The reload() method loads the certificate and key from disk again. If they can't be
+// loaded, the previous certificate is kept.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// The getCertificate() method can be used as the GetCertificate field of a tls.Config.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// The tlsConfig() method returns the TLS configuration for the API server, or nil if
+// TLS isn't enabled. (The config.validate() method has already checked that the
+// certificate and key files are given together.) Only TLS 1.2 and above are accepted,
+// and for TLS 1.2 we only allow forward-secret AEAD cipher suites (TLS 1.3 cipher
+// suites aren't configurable, and are all fine). Because the server is started with
+// ListenAndServeTLS(), HTTP/2 is negotiated automatically with clients which support
+// it.
+//
+// If a client CA file is given, clients may present a certificate signed by one of the
+// CAs in it, and the certificate's subject is made available to handlers as the
+// authenticated principal (see authenticateClientCert()). A certificate isn't required
+// to connect, as browsers, CORS front-ends and the orchestrator's health checks don't
+// have one. Instead, the routes which are only for service-to-service callers require
+// a principal with the requirePrincipal() middleware.
+//
+// A background goroutine is launched to reload the server certificate on SIGHUP.
+func (app *application) tlsConfig() (*tls.Config, error) {
+	if app.config.tls.certFile == "" {
+		return nil, nil
+	}
+
+	cr, err := newCertReloader(app.config.tls.certFile, app.config.tls.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		GetCertificate: cr.getCertificate,
+	}
+
+	if app.config.tls.clientCAFile != "" {
+		pem, err := os.ReadFile(app.config.tls.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", app.config.tls.clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			err := cr.reload()
+			if err != nil {
+				app.logger.Error("unable to reload TLS certificate, keeping the current one", "error", err.Error())
+				continue
+			}
+			app.logger.Info("reloaded TLS certificate", "cert", cr.certFile)
+		}
+	}()
+
+	return cfg, nil
+}
+
+// The principal type describes a client which has authenticated itself with a TLS
+// client certificate.
+type principal struct {
+	Subject      string
+	CommonName   string
+	SerialNumber string
+}
+
+// The authenticateClientCert() middleware adds the subject of the client's verified TLS
+// certificate (if it presented one) to the request context as the authenticated
+// principal, so that handlers can find out which service is calling them with the
+// contextGetPrincipal() helper.
+//
+// Note that a certificate which isn't signed by one of the client CAs fails the TLS
+// handshake, so any certificate in VerifiedChains has been verified.
+func (app *application) authenticateClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			r = app.contextSetPrincipal(r, &principal{
+				Subject:      cert.Subject.String(),
+				CommonName:   cert.Subject.CommonName,
+				SerialNumber: cert.SerialNumber.String(),
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requirePrincipal() middleware sends a 403 Forbidden response if client
+// certificates are enabled (with the -tls-client-ca flag) and the client didn't present
+// one. It's used for the routes which change movies, which are only for
+// service-to-service callers, while the read-only routes stay open to everyone. When
+// client certificates aren't enabled, every request is let through.
+func (app *application) requirePrincipal(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.hasRequiredPrincipal(r) {
+			app.clientCertificateRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The hasRequiredPrincipal() method reports whether the request can go on to a route
+// which requires a principal: either client certificates aren't enabled, or the client
+// presented a verified one.
+func (app *application) hasRequiredPrincipal(r *http.Request) bool {
+	return app.config.tls.clientCAFile == "" || app.contextGetPrincipal(r) != nil
+}
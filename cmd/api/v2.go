@@ -0,0 +1,209 @@
+package main
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"GoFurtherWebPractice/internal/recommender"
+	"GoFurtherWebPractice/internal/validator"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The movie endpoints are served under both /v1 and /v2, by the same handlers. The two
+// versions share the movie model, and only differ in how movies are represented:
+//
+//   - In v1, the runtime is a string like "102 mins", the timestamps are hidden unless
+//     they are asked for with the include parameter, and each endpoint uses its own
+//     envelope (like {"movie": ...} or {"movies": ..., "metadata": ...}).
+//   - In v2, the runtime is an integer number of minutes (and can also be given as an
+//     ISO 8601 duration like "PT1H42M" in request bodies), created_at and updated_at
+//     are always sent as RFC 3339 times, and every endpoint uses the same envelope:
+//     {"data": ..., "meta": ...} for successful responses, and {"error": {...}} for
+//     errors.
+//
+// The v1 movie endpoints are deprecated, which is announced to clients in the
+// Deprecation and Sunset headers (see deprecateV1()).
+
+// apiVersion returns the version of the API that the request is for, which is
+// determined by the prefix of its path. Everything which isn't under /v2 is v1.
+func apiVersion(r *http.Request) int {
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		return 2
+	}
+	return 1
+}
+
+// moviePath returns the path of a movie, in the same version of the API as the request.
+func moviePath(r *http.Request, id int64) string {
+	return fmt.Sprintf("/v%d/movies/%d", apiVersion(r), id)
+}
+
+// The readFieldSet() helper reads the query string values which control the movie fields
+// that are sent in a response. In v1, these are the fields and include parameters. In
+// v2, there is just the fields parameter, which can select any of the fields (including
+// the timestamps), and which defaults to all of them. The id is always sent in v2, as
+// it's needed for the links.
+func (app *application) readFieldSet(r *http.Request) data.FieldSet {
+	qs := r.URL.Query()
+	if apiVersion(r) == 1 {
+		return data.FieldSet{
+			Fields:  app.readCSV(qs, "fields", nil),
+			Include: app.readCSV(qs, "include", nil),
+		}
+	}
+
+	fields := app.readCSV(qs, "fields", nil)
+	if fields == nil {
+		return data.FieldSet{Include: data.MovieIncludeSafelist}
+	}
+	var fs data.FieldSet
+	for _, field := range fields {
+		if validator.PermittedValue(field, data.MovieIncludeSafelist...) {
+			fs.Include = append(fs.Include, field)
+		} else {
+			fs.Fields = append(fs.Fields, field)
+		}
+	}
+	if !validator.PermittedValue("id", fs.Fields...) {
+		fs.Fields = append([]string{"id"}, fs.Fields...)
+	}
+	return fs
+}
+
+// The movieResource() helper returns the representation of a movie to include in a
+// response. In v1, that's the fields from the field set (see data.FieldSet.Project()),
+// plus a _links object. In v2, it's the v2 representation from movieResourceV2().
+func (app *application) movieResource(r *http.Request, movie *data.Movie, fields data.FieldSet) any {
+	if apiVersion(r) == 2 {
+		return app.movieResourceV2(movie, fields)
+	}
+
+	links := movieLinks{
+		Self:    moviePath(r, movie.ID),
+		Similar: moviePath(r, movie.ID) + "/similar",
+	}
+	switch projected := fields.Project(movie).(type) {
+	case map[string]any:
+		projected["_links"] = links
+		return projected
+	default:
+		return struct {
+			*data.Movie
+			Links movieLinks `json:"_links"`
+		}{movie, links}
+	}
+}
+
+// movieFieldsV2 lists the fields of the v2 movie representation, in the order that
+// they're sent in.
+var movieFieldsV2 = []string{"id", "title", "year", "runtime", "genres", "version", "created_at", "updated_at"}
+
+// The movieResourceV2() helper returns the v2 representation of a movie, containing the
+// fields from the field set, followed by the links. We use an orderedMap so that the
+// fields are always sent in the same order, whichever of them were chosen.
+func (app *application) movieResourceV2(movie *data.Movie, fields data.FieldSet) orderedMap {
+	if len(fields.Fields) == 0 && len(fields.Include) == 0 {
+		fields.Include = data.MovieIncludeSafelist
+	}
+	selected := fields.Selected()
+	var resource orderedMap
+	for _, field := range movieFieldsV2 {
+		if !validator.PermittedValue(field, selected...) {
+			continue
+		}
+		var value any
+		switch field {
+		case "id":
+			value = movie.ID
+		case "title":
+			value = movie.Title
+		case "year":
+			value = movie.Year
+		case "runtime":
+			value = int32(movie.Runtime)
+		case "genres":
+			value = movie.Genres
+		case "version":
+			value = movie.Version
+		case "created_at":
+			value = movie.CreatedAt.UTC().Format(time.RFC3339)
+		case "updated_at":
+			value = movie.UpdatedAt.UTC().Format(time.RFC3339)
+		}
+		resource = append(resource, orderedField{field, value})
+	}
+	links := movieLinks{
+		Self:    fmt.Sprintf("/v2/movies/%d", movie.ID),
+		Similar: fmt.Sprintf("/v2/movies/%d/similar", movie.ID),
+	}
+	return append(resource, orderedField{"links", links})
+}
+
+// The movieResources() helper applies movieResource() to each of the movies.
+func (app *application) movieResources(r *http.Request, movies []*data.Movie, fields data.FieldSet) []any {
+	resources := make([]any, len(movies))
+	for i, movie := range movies {
+		resources[i] = app.movieResource(r, movie, fields)
+	}
+	return resources
+}
+
+// The similarResources() helper returns the representation of a list of similar movies.
+// In v1 the results are sent as they are, and in v2 each movie is given its v2
+// representation.
+func (app *application) similarResources(r *http.Request, results []recommender.Result) any {
+	if apiVersion(r) == 1 {
+		return results
+	}
+	resources := make([]envelope, len(results))
+	for i, result := range results {
+		resources[i] = envelope{"score": result.Score, "movie": app.movieResourceV2(result.Movie, data.FieldSet{})}
+	}
+	return resources
+}
+
+// The dataEnvelope() helper returns the envelope for a successful response. In v1, the
+// value is sent under the given name, with the pagination metadata (if there is any)
+// under "metadata". In v2, they're always sent under "data" and "meta".
+func (app *application) dataEnvelope(r *http.Request, name string, value any, metadata *data.Metadata) envelope {
+	if apiVersion(r) == 1 {
+		env := envelope{name: value}
+		if metadata != nil {
+			env["metadata"] = *metadata
+		}
+		return env
+	}
+	env := envelope{"data": value}
+	if metadata != nil {
+		env["meta"] = *metadata
+	}
+	return env
+}
+
+// The readRuntime() helper converts the raw JSON value of a runtime field in a request
+// body to a data.Runtime. In v1, it must be a string like "102 mins". In v2, it can be
+// either an integer number of minutes or an ISO 8601 duration string like "PT1H42M". An
+// empty or null value is returned as zero, which ValidateMovie() rejects.
+func (app *application) readRuntime(r *http.Request, raw json.RawMessage) (data.Runtime, error) {
+	var runtime data.Runtime
+	if len(raw) == 0 {
+		return runtime, nil
+	}
+	if apiVersion(r) == 1 {
+		err := json.Unmarshal(raw, &runtime)
+		return runtime, err
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return data.ParseISORuntime(s)
+	}
+	var minutes int32
+	err := json.Unmarshal(raw, &minutes)
+	if err != nil {
+		return 0, data.ErrInvalidRuntimeFormat
+	}
+	return data.Runtime(minutes), nil
+}
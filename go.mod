@@ -4,4 +4,14 @@ go 1.22.3
 
 require github.com/julienschmidt/httprouter v1.3.0
 
-require github.com/lib/pq v1.10.9 // indirect
+require github.com/lib/pq v1.10.9
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/graphql-go/graphql v0.8.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
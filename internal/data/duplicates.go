@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Duplicate describes an existing movie which looks like it might be the same film as
+// a movie that is about to be created. Exact is true when the normalized title and
+// year match exactly; otherwise the record was picked up because its title is similar
+// enough (Similarity is the pg_trgm similarity of the two normalized titles).
+type Duplicate struct {
+	Movie      *Movie
+	Similarity float64
+	Exact      bool
+}
+
+// The FindDuplicates() method looks for existing movies which are likely to be the
+// same film as the given movie. It returns exact matches on normalized title and year,
+// plus near-duplicates released within a year either side whose normalized title has a
+// similarity of at least threshold. Exact matches are returned first, followed by the
+// closest near-duplicates, up to a maximum of 5 records.
+func (m MovieModel) FindDuplicates(movie *Movie, threshold float64) ([]*Duplicate, error) {
+	// The % operator lets PostgreSQL use the trigram index to find candidates cheaply
+	// (using the default pg_trgm.similarity_threshold of 0.3), before we filter them
+	// precisely with the similarity() function.
+	query := `
+	SELECT id, created_at, updated_at, title, year, runtime, genres, version,
+		similarity(normalized_title, movies_normalize_title($1)),
+		normalized_title = movies_normalize_title($1) AND year = $2
+	FROM movies
+	WHERE (normalized_title = movies_normalize_title($1) AND year = $2)
+		OR (normalized_title % movies_normalize_title($1)
+			AND similarity(normalized_title, movies_normalize_title($1)) >= $3
+			AND year BETWEEN $2 - 1 AND $2 + 1)
+	ORDER BY 10 DESC, 9 DESC, id ASC
+	LIMIT 5`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), movie.Title, movie.Year, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []*Duplicate{}
+	for rows.Next() {
+		var existing Movie
+		var duplicate Duplicate
+		err := rows.Scan(
+			&existing.ID,
+			&existing.CreatedAt,
+			&existing.UpdatedAt,
+			&existing.Title,
+			&existing.Year,
+			&existing.Runtime,
+			pq.Array(&existing.Genres),
+			&existing.Version,
+			&duplicate.Similarity,
+			&duplicate.Exact,
+		)
+		if err != nil {
+			return nil, err
+		}
+		duplicate.Movie = &existing
+		duplicates = append(duplicates, &duplicate)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// MergeGenres returns the union of the canonical and duplicate genres, keeping the
+// canonical genres first and in their original order.
+func MergeGenres(canonical, duplicate []string) []string {
+	merged := make([]string, 0, len(canonical)+len(duplicate))
+	seen := make(map[string]bool, len(canonical)+len(duplicate))
+	for _, genres := range [][]string{canonical, duplicate} {
+		for _, genre := range genres {
+			if !seen[genre] {
+				seen[genre] = true
+				merged = append(merged, genre)
+			}
+		}
+	}
+	return merged
+}
+
+// The Merge() method folds the duplicate movie into the canonical one. The canonical
+// record is updated with the given genres (normally the result of MergeGenres()) and
+// takes on the duplicate's popularity, and then the duplicate record is deleted. Both
+// steps happen in a single transaction, and both are guarded by the version numbers of
+// the movie structs, so if either record has been changed since it was read we return
+// ErrEditConflict and nothing is modified.
+func (m MovieModel) Merge(canonical, duplicate *Movie, genres []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Calling Rollback() after a successful Commit() is a no-op, so it's safe to defer
+	// it here to clean up on any of the error paths below.
+	defer tx.Rollback()
+
+	query := `
+	DELETE FROM movies
+	WHERE id = $1 AND version = $2
+	RETURNING popularity`
+
+	var popularity int
+	err = tx.QueryRowContext(ctx, m.annotate(query), duplicate.ID, duplicate.Version).Scan(&popularity)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	query = `
+	UPDATE movies
+	SET genres = $1, popularity = popularity + $2, version = version + 1, updated_at = NOW()
+	WHERE id = $3 AND version = $4
+	RETURNING version, updated_at`
+
+	args := []any{pq.Array(genres), popularity, canonical.ID, canonical.Version}
+	err = tx.QueryRowContext(ctx, m.annotate(query), args...).Scan(&canonical.Version, &canonical.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	canonical.Genres = genres
+
+	return tx.Commit()
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"GoFurtherWebPractice/internal/validator"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Define the movie fields which clients can select with the fields query string
+// parameter, and the hidden fields (which are normally left out of responses) that they
+// can opt in to with the include parameter.
+var (
+	MovieFieldSafelist   = []string{"id", "title", "year", "runtime", "genres", "version"}
+	MovieIncludeSafelist = []string{"created_at", "updated_at"}
+)
+
+// movieColumns lists every column that a Movie struct is read from, in table order.
+var movieColumns = []string{"id", "created_at", "title", "year", "runtime", "genres", "version", "updated_at"}
+
+// FieldSet describes which movie fields a client wants back. An empty Fields slice
+// means "all of the default fields", and Include lists any hidden fields to add on top.
+type FieldSet struct {
+	Fields  []string
+	Include []string
+}
+
+func ValidateFieldSet(v *validator.Validator, fs FieldSet) {
+	for _, field := range fs.Fields {
+		v.Check(validator.PermittedValue(field, MovieFieldSafelist...), "fields", fmt.Sprintf("unknown field %q", field))
+	}
+	v.Check(validator.Unique(fs.Fields), "fields", "must not contain duplicate values")
+	for _, field := range fs.Include {
+		v.Check(validator.PermittedValue(field, MovieIncludeSafelist...), "include", fmt.Sprintf("unknown field %q", field))
+	}
+	v.Check(validator.Unique(fs.Include), "include", "must not contain duplicate values")
+}
+
+// The Selected() method returns the names of every field in the set, including the
+// hidden ones which were asked for, in table order.
+func (fs FieldSet) Selected() []string {
+	fields := fs.Fields
+	if len(fields) == 0 {
+		fields = MovieFieldSafelist
+	}
+	var selected []string
+	for _, name := range movieColumns {
+		if validator.PermittedValue(name, fields...) || validator.PermittedValue(name, fs.Include...) {
+			selected = append(selected, name)
+		}
+	}
+	return selected
+}
+
+// The columns() method returns the movies table columns needed to populate the field
+// set. When the client hasn't asked for specific fields we fetch every column, so that
+// callers always get a fully populated Movie struct in the default case. Otherwise we
+// always include the id column, even if it wasn't asked for, because it's needed to
+// generate the links to the movie.
+func (fs FieldSet) columns() []string {
+	if len(fs.Fields) == 0 {
+		return movieColumns
+	}
+	columns := fs.Selected()
+	if !validator.PermittedValue("id", columns...) {
+		columns = append([]string{"id"}, columns...)
+	}
+	return columns
+}
+
+// The scanDest() method returns the Scan() destination in the movie struct for the
+// given column.
+func (movie *Movie) scanDest(column string) any {
+	switch column {
+	case "id":
+		return &movie.ID
+	case "created_at":
+		return &movie.CreatedAt
+	case "title":
+		return &movie.Title
+	case "year":
+		return &movie.Year
+	case "runtime":
+		return &movie.Runtime
+	case "genres":
+		return pq.Array(&movie.Genres)
+	case "version":
+		return &movie.Version
+	case "updated_at":
+		return &movie.UpdatedAt
+	}
+	panic("unknown movie column: " + column)
+}
+
+// The Project() method returns the representation of the movie that should be encoded
+// in a response. If the client hasn't asked for specific fields or any hidden ones, we
+// return the movie itself so that the default output is unchanged. Otherwise we return
+// a map containing just the requested fields.
+func (fs FieldSet) Project(movie *Movie) any {
+	if len(fs.Fields) == 0 && len(fs.Include) == 0 {
+		return movie
+	}
+	projected := make(map[string]any)
+	for _, field := range fs.Selected() {
+		switch field {
+		case "id":
+			projected[field] = movie.ID
+		case "created_at":
+			projected[field] = movie.CreatedAt
+		case "title":
+			projected[field] = movie.Title
+		case "year":
+			projected[field] = movie.Year
+		case "runtime":
+			projected[field] = movie.Runtime
+		case "genres":
+			projected[field] = movie.Genres
+		case "version":
+			projected[field] = movie.Version
+		case "updated_at":
+			projected[field] = movie.UpdatedAt
+		}
+	}
+	return projected
+}
@@ -3,43 +3,139 @@ package data
 import (
 	"GoFurtherWebPractice/internal/validator"
 	"math"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
-// Add a SortSafelist field to hold the supported sort values.
+// Define the supported modes for calculating the total number of records in a
+// listing. TotalExact counts every matching record, TotalEstimate uses the query
+// planner's estimate instead, and TotalNone skips the total altogether and only
+// reports whether there is a next page.
+const (
+	TotalExact    = "exact"
+	TotalEstimate = "estimate"
+	TotalNone     = "none"
+)
+
+// Add a SortSafelist field to hold the supported sort values. Sort holds one or more
+// sort keys in order of precedence, each of which must appear in the safelist. Total
+// holds one of the total modes above. URL is the URL of the current request, which we
+// use to generate the pagination links.
 type Filters struct {
 	Page         int
 	PageSize     int
-	Sort         string
+	Sort         []string
 	SortSafelist []string
+	Total        string
+	URL          *url.URL
 }
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int              `json:"current_page,omitempty"`
+	PageSize     int              `json:"page_size,omitempty"`
+	FirstPage    int              `json:"first_page,omitempty"`
+	LastPage     int              `json:"last_page,omitempty"`
+	TotalRecords int              `json:"total_records,omitempty"`
+	TotalMode    string           `json:"total_mode,omitempty"`
+	HasNext      *bool            `json:"has_next,omitempty"`
+	Links        *PaginationLinks `json:"links,omitempty"`
+}
+
+// PaginationLinks holds the URLs of the pages around the current one, so that clients
+// can navigate through a listing without having to build query strings themselves.
+// Prev and Next are left empty on the first and last pages respectively, and Last is
+// left empty when the total number of records isn't known.
+type PaginationLinks struct {
+	Self  string `json:"self"`
+	First string `json:"first"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
-// values given the total number of records, current page, and page size values. Note
-// that the last page value is calculated using the math.Ceil() function, which rounds
-// up a float to the nearest integer. So, for example, if there were 12 records in total
-// and a page size of 5, the last page value would be math.Ceil(12/5) = 3.
-func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+// values given the total number of records and the current filters. Note that the last
+// page value is calculated using the math.Ceil() function, which rounds up a float to
+// the nearest integer. So, for example, if there were 12 records in total and a page
+// size of 5, the last page value would be math.Ceil(12/5) = 3.
+func calculateMetadata(totalRecords int, filters Filters) Metadata {
 	if totalRecords == 0 {
 		// Note that we return an empty Metadata struct if there are no records.
 		return Metadata{}
 	}
-	return Metadata{
-		CurrentPage:  page,
-		PageSize:     pageSize,
+	lastPage := int(math.Ceil(float64(totalRecords) / float64(filters.PageSize)))
+	hasNext := filters.Page < lastPage
+	metadata := Metadata{
+		CurrentPage:  filters.Page,
+		PageSize:     filters.PageSize,
 		FirstPage:    1,
-		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		LastPage:     lastPage,
 		TotalRecords: totalRecords,
+		TotalMode:    filters.totalMode(),
+		HasNext:      &hasNext,
+	}
+	// Generate the pagination links, if we know the URL of the current request.
+	if filters.URL != nil {
+		metadata.Links = &PaginationLinks{
+			Self:  filters.pageURL(metadata.CurrentPage),
+			First: filters.pageURL(metadata.FirstPage),
+			Last:  filters.pageURL(metadata.LastPage),
+		}
+		if metadata.CurrentPage > metadata.FirstPage {
+			metadata.Links.Prev = filters.pageURL(min(metadata.CurrentPage-1, metadata.LastPage))
+		}
+		if hasNext {
+			metadata.Links.Next = filters.pageURL(metadata.CurrentPage + 1)
+		}
+	}
+	return metadata
+}
+
+// The calculateMetadataWithoutTotal() function calculates the pagination metadata for
+// listings where we don't know the total number of records, so all we can report is
+// the current page and whether there is a page after it.
+func calculateMetadataWithoutTotal(hasNext bool, filters Filters) Metadata {
+	metadata := Metadata{
+		CurrentPage: filters.Page,
+		PageSize:    filters.PageSize,
+		FirstPage:   1,
+		TotalMode:   filters.totalMode(),
+		HasNext:     &hasNext,
+	}
+	if filters.URL != nil {
+		metadata.Links = &PaginationLinks{
+			Self:  filters.pageURL(metadata.CurrentPage),
+			First: filters.pageURL(metadata.FirstPage),
+		}
+		if metadata.CurrentPage > metadata.FirstPage {
+			metadata.Links.Prev = filters.pageURL(metadata.CurrentPage - 1)
+		}
+		if hasNext {
+			metadata.Links.Next = filters.pageURL(metadata.CurrentPage + 1)
+		}
 	}
+	return metadata
+}
+
+// The totalMode() method returns the total mode for the filters, defaulting to
+// TotalExact if none was set.
+func (f Filters) totalMode() string {
+	if f.Total == "" {
+		return TotalExact
+	}
+	return f.Total
+}
+
+// The pageURL() method returns the URL for the given page of the current listing. All
+// of the other query string parameters from the request (the title, genres and sort
+// filters, and so on) are carried over unchanged.
+func (f Filters) pageURL(page int) string {
+	qs := f.URL.Query()
+	qs.Set("page", strconv.Itoa(page))
+	u := url.URL{Path: f.URL.Path, RawQuery: qs.Encode()}
+	return u.String()
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -48,28 +144,45 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// Check that the sort parameter contains at least one key, that every key matches
+	// a value in the safelist, and that no column is sorted on more than once.
+	v.Check(len(f.Sort) > 0, "sort", "must be provided")
+	columns := make([]string, len(f.Sort))
+	for i, key := range f.Sort {
+		v.Check(validator.PermittedValue(key, f.SortSafelist...), "sort", "invalid sort value")
+		columns[i] = strings.TrimPrefix(key, "-")
+	}
+	v.Check(validator.Unique(columns), "sort", "must not sort on the same field more than once")
+	// Check that the total parameter (if provided) is one of the supported modes.
+	v.Check(f.Total == "" || validator.PermittedValue(f.Total, TotalExact, TotalEstimate, TotalNone), "total", "must be exact, estimate or none")
 }
 
-// Check that the client-provided Sort field matches one of the entries in our safelist
-// and if it does, extract the column name from the Sort field by stripping the leading // hyphen character (if one exists).
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// Check that every client-provided Sort key matches one of the entries in our safelist
+// and if they do, build the ORDER BY clause from them. The column name for each key is
+// extracted by stripping the leading hyphen character (if one exists), which also
+// tells us to sort that column in descending order. Because the column names come from
+// our safelist rather than straight from the client, it's safe to interpolate the
+// result into a SQL query. We always finish with "id ASC" as a tie-breaker (unless the
+// client already sorted on id), so that the ordering is stable between pages.
+func (f Filters) orderBy() string {
+	clauses := make([]string, 0, len(f.Sort)+1)
+	sortedByID := false
+	for _, key := range f.Sort {
+		if !validator.PermittedValue(key, f.SortSafelist...) {
+			panic("unsafe sort parameter: " + key)
+		}
+		column := strings.TrimPrefix(key, "-")
+		direction := "ASC"
+		if strings.HasPrefix(key, "-") {
+			direction = "DESC"
 		}
+		clauses = append(clauses, column+" "+direction)
+		sortedByID = sortedByID || column == "id"
 	}
-	panic("unsafe sort parameter: " + f.Sort)
-}
-
-// Return the sort direction ("ASC" or "DESC") depending on the prefix character of the
-// Sort field.
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+	if !sortedByID {
+		clauses = append(clauses, "id ASC")
 	}
-	return "ASC"
+	return strings.Join(clauses, ", ")
 }
 
 func (f Filters) limit() int {
@@ -79,3 +192,13 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
+// The PageBounds() method is the in-memory counterpart of limit() and offset(), for
+// result sets which are ranked by application code rather than ordered by the
+// database. It returns the start and end indexes of the current page within a result
+// set containing totalRecords items, along with the matching pagination metadata.
+func (f Filters) PageBounds(totalRecords int) (int, int, Metadata) {
+	start := min(f.offset(), totalRecords)
+	end := min(start+f.limit(), totalRecords)
+	return start, end, calculateMetadata(totalRecords, f)
+}
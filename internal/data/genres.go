@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Genre holds one of the genres which movies are tagged with, and how many movies
+// have it.
+type Genre struct {
+	Name   string `json:"name"`
+	Movies int    `json:"movies"`
+}
+
+// The GetGenres() method returns every genre which at least one movie has, in
+// alphabetical order, along with the number of movies that have it.
+func (m MovieModel) GetGenres() ([]*Genre, error) {
+	query := `
+	SELECT genre, count(*)
+	FROM movies, unnest(genres) AS genre
+	GROUP BY genre
+	ORDER BY genre ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+	for rows.Next() {
+		var genre Genre
+		err := rows.Scan(&genre.Name, &genre.Movies)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+// The GetForGenres() method returns the first movies (by ID) with each of the given
+// genres, up to limit movies per genre, keyed by genre. The movies for every genre are
+// fetched in a single query, using a lateral join which runs the per-genre query (answered
+// by the movies_genres_idx index) for each genre in the list. This lets callers which
+// need the movies for a number of genres avoid making a query for each one.
+func (m MovieModel) GetForGenres(genres []string, limit int) (map[string][]*Movie, error) {
+	query := `
+	SELECT g.genre, m.id, m.created_at, m.updated_at, m.title, m.year, m.runtime, m.genres, m.version
+	FROM unnest($1::text[]) AS g(genre)
+	CROSS JOIN LATERAL (
+		SELECT id, created_at, updated_at, title, year, runtime, genres, version
+		FROM movies
+		WHERE genres @> ARRAY[g.genre]
+		ORDER BY id ASC
+		LIMIT $2
+	) AS m
+	ORDER BY g.genre, m.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), pq.Array(genres), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := make(map[string][]*Movie, len(genres))
+	for _, genre := range genres {
+		movies[genre] = []*Movie{}
+	}
+	for rows.Next() {
+		var genre string
+		var movie Movie
+		err := rows.Scan(
+			&genre,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies[genre] = append(movies[genre], &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
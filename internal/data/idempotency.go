@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Define the errors that Reserve() returns when an idempotency key can't be used for
+// the current request.
+var (
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyKeyInFlight = errors.New("idempotency key in use by a request in flight")
+)
+
+// IdempotentResponse holds the parts of a response which are replayed to clients that
+// retry a request with the same idempotency key.
+type IdempotentResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    []byte
+}
+
+// IdempotencyReservation identifies the claim on an idempotency key made by one call to
+// Reserve(). Complete() and Release() only change the key while it's still held by the
+// same reservation, so a request which outlives its lease can't overwrite or delete the
+// key after another request has claimed it.
+type IdempotencyReservation struct {
+	Key         string
+	RequestHash string
+	ReservedAt  time.Time
+}
+
+// Define an IdempotencyKeyModel struct type which wraps a sql.DB connection pool.
+type IdempotencyKeyModel struct {
+	DB *sql.DB
+}
+
+// The Reserve() method claims an idempotency key for a request whose method, path and
+// body hash to requestHash. If the key was free, it returns the new reservation and a
+// nil response, in which case the caller should process the request and then pass the
+// reservation to Complete() or Release(). If the key has already been used for an
+// identical request which has finished, the stored response is returned so that it
+// can be replayed. If the key was used for a different request,
+// ErrIdempotencyKeyMismatch is returned, and if the original request is still being
+// processed, ErrIdempotencyKeyInFlight.
+//
+// A stored response is kept until the ttl has passed. A reservation without a response
+// only holds the key for the (much shorter) lease, so that if the process dies while
+// handling the request, and Release() is never called, retries with the same key are
+// turned away for a few minutes at most, rather than until the ttl has passed.
+func (m IdempotencyKeyModel) Reserve(key, requestHash string, ttl, lease time.Duration) (*IdempotencyReservation, *IdempotentResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Clear out any expired record or stale reservation for this key first, so that it
+	// can be reused.
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE key = $1 AND (
+		expires_at <= NOW() OR
+		(status IS NULL AND reserved_at <= NOW() - make_interval(secs => $2))
+	)`
+
+	_, err := m.DB.ExecContext(ctx, query, key, lease.Seconds())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Try to claim the key. The record has a NULL status until the request completes,
+	// which is how we tell that a request is still in flight. If the key is already
+	// taken, nothing is inserted and so no row is returned.
+	query = `
+	INSERT INTO idempotency_keys (key, request_hash, reserved_at, expires_at)
+	VALUES ($1, $2, NOW(), NOW() + make_interval(secs => $3))
+	ON CONFLICT (key) DO NOTHING
+	RETURNING reserved_at`
+
+	reservation := &IdempotencyReservation{Key: key, RequestHash: requestHash}
+	err = m.DB.QueryRowContext(ctx, query, key, requestHash, ttl.Seconds()).Scan(&reservation.ReservedAt)
+	switch {
+	case err == nil:
+		return reservation, nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, nil, err
+	}
+
+	// Otherwise the key is already taken, so fetch the existing record.
+	query = `
+	SELECT request_hash, status, headers, body
+	FROM idempotency_keys
+	WHERE key = $1`
+
+	var (
+		storedHash string
+		status     sql.NullInt64
+		headers    []byte
+		response   IdempotentResponse
+	)
+	err = m.DB.QueryRowContext(ctx, query, key).Scan(&storedHash, &status, &headers, &response.Body)
+	if err != nil {
+		switch {
+		// The record was released between our INSERT and SELECT, which means that
+		// another request is racing us for the key.
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrIdempotencyKeyInFlight
+		default:
+			return nil, nil, err
+		}
+	}
+
+	switch {
+	case storedHash != requestHash:
+		return nil, nil, ErrIdempotencyKeyMismatch
+	case !status.Valid:
+		return nil, nil, ErrIdempotencyKeyInFlight
+	}
+
+	response.Status = int(status.Int64)
+	if len(headers) > 0 {
+		err = json.Unmarshal(headers, &response.Headers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, &response, nil
+}
+
+// The DeleteExpired() method deletes every idempotency key whose ttl has passed, and
+// returns how many were deleted. Reserve() only clears out an expired key when it's
+// reused, so this needs to be called periodically to stop the table from growing
+// without bound.
+func (m IdempotencyKeyModel) DeleteExpired() (int64, error) {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE expires_at <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// The Complete() method stores the response for a reserved idempotency key, so that it
+// can be replayed to clients which retry the same request. Nothing is stored if the
+// reservation has since been lost to another request.
+func (m IdempotencyKeyModel) Complete(reservation *IdempotencyReservation, response *IdempotentResponse) error {
+	headers, err := json.Marshal(response.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE idempotency_keys
+	SET status = $1, headers = $2, body = $3
+	WHERE key = $4 AND request_hash = $5 AND reserved_at = $6 AND status IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Note that we pass the headers as a string, because pq sends []byte values in
+	// binary format, which PostgreSQL won't accept for a JSONB column.
+	_, err = m.DB.ExecContext(ctx, query, response.Status, string(headers), response.Body, reservation.Key, reservation.RequestHash, reservation.ReservedAt)
+	return err
+}
+
+// The Release() method deletes a reserved idempotency key without storing a response,
+// so that the client is free to retry the request (for example, after a server error).
+// Like Complete(), it leaves the key alone if another request has claimed it since.
+func (m IdempotencyKeyModel) Release(reservation *IdempotencyReservation) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE key = $1 AND request_hash = $2 AND reserved_at = $3 AND status IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, reservation.Key, reservation.RequestHash, reservation.ReservedAt)
+	return err
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -15,14 +17,54 @@ var (
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 // Create a Models struct which wraps the MovieModel. We'll add other models to this, // like a UserModel and PermissionModel, as our build progresses.
+//
+// The fields hold interfaces rather than the models themselves, so that the handlers
+// can be tested against an in-memory fake in place of a real database. NewModels()
+// fills them in with the PostgreSQL models.
 type Models struct {
-	Movies MovieModel
+	Movies          MovieStore
+	IdempotencyKeys IdempotencyKeyStore
+	Schema          SchemaStore
+}
+
+// MovieStore is implemented by MovieModel. See its methods for what each one does.
+type MovieStore interface {
+	WithRequestID(requestID string) MovieStore
+	Insert(movie *Movie) error
+	Get(id int64) (*Movie, error)
+	GetFields(id int64, fields FieldSet) (*Movie, error)
+	Update(movie *Movie) error
+	Delete(id int64) error
+	GetAll(title string, genres []string, filters Filters, fields FieldSet) ([]*Movie, Metadata, error)
+	Suggest(prefix string, limit int) ([]*MovieSuggestion, error)
+	IncrementPopularity(id int64) error
+	GetSimilarCandidates(movie *Movie, limit int) ([]*Movie, error)
+	GetSimilarCandidatesForMany(ids []int64, limit int) (map[int64][]*Movie, error)
+	FindDuplicates(movie *Movie, threshold float64) ([]*Duplicate, error)
+	Merge(canonical, duplicate *Movie, genres []string) error
+	GetGenres() ([]*Genre, error)
+	GetForGenres(genres []string, limit int) (map[string][]*Movie, error)
+}
+
+// IdempotencyKeyStore is implemented by IdempotencyKeyModel.
+type IdempotencyKeyStore interface {
+	Reserve(key, requestHash string, ttl, lease time.Duration) (*IdempotencyReservation, *IdempotentResponse, error)
+	Complete(reservation *IdempotencyReservation, response *IdempotentResponse) error
+	Release(reservation *IdempotencyReservation) error
+	DeleteExpired() (int64, error)
+}
+
+// SchemaStore is implemented by SchemaModel.
+type SchemaStore interface {
+	Version(ctx context.Context) (int64, bool, error)
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies: MovieModel{DB: db},
+		Movies:          MovieModel{DB: db},
+		IdempotencyKeys: IdempotencyKeyModel{DB: db},
+		Schema:          SchemaModel{DB: db},
 	}
 }
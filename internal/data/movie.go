@@ -4,16 +4,40 @@ import (
 	"GoFurtherWebPractice/internal/validator" // New import
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 )
 
-// Define a MovieModel struct type which wraps a sql.DB connection pool.
+// Define a MovieModel struct type which wraps a sql.DB connection pool. The requestID
+// field holds the ID of the HTTP request that the model is being used for (if any),
+// which we add as a comment to every query that the model runs. That way, a query which
+// shows up in the PostgreSQL logs (as a slow query, say) can be traced back to the
+// request which caused it.
 type MovieModel struct {
-	DB *sql.DB
+	DB        *sql.DB
+	requestID string
+}
+
+// The WithRequestID() method returns a copy of the model which tags its queries with the
+// given request ID.
+func (m MovieModel) WithRequestID(requestID string) MovieStore {
+	m.requestID = requestID
+	return m
+}
+
+// The annotate() method prefixes the query with a comment containing the request ID.
+// Request IDs can come from clients, so to be certain that one can't break out of the
+// comment we leave it out altogether unless it only contains safe characters.
+func (m MovieModel) annotate(query string) string {
+	if m.requestID == "" || !validator.Matches(m.requestID, validator.RequestIDRX) {
+		return query
+	}
+	return "/* request_id=" + m.requestID + " */" + query
 }
 
 type MockMovieModel struct{}
@@ -21,13 +45,14 @@ type MockMovieModel struct{}
 type Movie struct {
 	// Runtime and Genres fields in the output if and only if they are empty.
 	// Notice that the leading comma is still required.
-	ID        int64     `json:"id"`                        // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`                         // Timestamp for when the movie is added to our database Use the - directive
-	Title     string    `json:"title"`                     // Movie title
-	Year      int32     `json:"year    ,omitempty"`        // Movie release year
-	Runtime   Runtime   `json:"runtime ,omitempty,string"` // Movie runtime (in minutes) to be represented as a JSON string
-	Genres    []string  `json:"genres  ,omitempty"`        // Slice of genres for the movie (romance, comedy, etc.)
-	Version   int32     `json:"version"`                   // The version number starts at 1 and will be incremented each
+	ID        int64     `json:"id"`                       // Unique integer ID for the movie
+	CreatedAt time.Time `json:"-"`                        // Timestamp for when the movie is added to our database Use the - directive
+	UpdatedAt time.Time `json:"-"`                        // Timestamp for when the movie was last updated
+	Title     string    `json:"title"`                    // Movie title
+	Year      int32     `json:"year,omitempty"`           // Movie release year
+	Runtime   Runtime   `json:"runtime,omitempty,string"` // Movie runtime (in minutes) to be represented as a JSON string
+	Genres    []string  `json:"genres,omitempty"`         // Slice of genres for the movie (romance, comedy, etc.)
+	Version   int32     `json:"version"`                  // The version number starts at 1 and will be incremented each
 	// time the movie information is updated
 
 	// Use the Runtime type instead of int32. Note that the omitempty directive will
@@ -64,7 +89,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 	query := `
 	INSERT INTO movies (title, year, runtime, genres) 
 	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
+	RETURNING id, created_at, updated_at, version`
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
@@ -73,10 +98,16 @@ func (m MovieModel) Insert(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return m.DB.QueryRowContext(ctx, m.annotate(query), args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.GetFields(id, FieldSet{})
+}
+
+// The GetFields() method works like Get(), but only reads the columns needed for the
+// given field set, leaving the other fields of the returned movie as zero values.
+func (m MovieModel) GetFields(id int64, fields FieldSet) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -84,13 +115,21 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
-	// Define the SQL query for retrieving the movie data.
-	query := `
-	SELECT id, created_at, title, year, runtime, genres, version 
+	// Define the SQL query for retrieving the movie data. The column names come from
+	// our own list in fields.go rather than from the client, so it's safe to
+	// interpolate them here.
+	columns := fields.columns()
+	query := fmt.Sprintf(`
+	SELECT %s
 	FROM movies
-	WHERE id = $1`
-	// Declare a Movie struct to hold the data returned by the query.
+	WHERE id = $1`, strings.Join(columns, ", "))
+	// Declare a Movie struct to hold the data returned by the query, and collect the
+	// Scan() destinations for each of the selected columns.
 	var movie Movie
+	dest := make([]any, len(columns))
+	for i, column := range columns {
+		dest[i] = movie.scanDest(column)
+	}
 
 	// Use the context.WithTimeout() function to create a context.Context which carries a
 	// 3-second timeout deadline. Note that we're using the empty context.Background()
@@ -102,15 +141,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Use the QueryRowContext() method to execute the query, passing in the context
 	// with the deadline as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, m.annotate(query), id).Scan(dest...)
 	// Handle any errors. If there was no matching movie found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
 	// error instead.
@@ -128,12 +159,12 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 func (m MovieModel) Update(movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version
-	// number.
+	// number and update time.
 	query := `
 	UPDATE movies
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1 
+	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1, updated_at = NOW()
 	WHERE id = $5 AND version = $6
-	RETURNING version`
+	RETURNING version, updated_at`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -150,7 +181,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	// Execute the SQL query. If no matching row could be found, we know the movie
 	// version has changed (or the record has been deleted) and we return our custom
 	// ErrEditConflict error.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, m.annotate(query), args...).Scan(&movie.Version, &movie.UpdatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -162,6 +193,23 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
+// The IncrementPopularity() method adds one to the popularity of a movie, which counts
+// how many times it has been viewed. Unlike Update(), it doesn't change the version or
+// the updated_at time, as a view isn't an edit, and mustn't cause edit conflicts for
+// clients which are changing the movie.
+func (m MovieModel) IncrementPopularity(id int64) error {
+	query := `
+	UPDATE movies
+	SET popularity = popularity + 1
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, m.annotate(query), id)
+	return err
+}
+
 func (m MovieModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
@@ -176,7 +224,7 @@ func (m MovieModel) Delete(id int64) error {
 	// Execute the SQL query using the Exec() method, passing in the id variable as
 	// the value for the placeholder parameter. The Exec() method returns a sql.Result
 	// object.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, m.annotate(query), id)
 	if err != nil {
 		return err
 	}
@@ -195,16 +243,34 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-// Update the function signature to return a Metadata struct.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	// Update the SQL query to include the window function which counts the total
-	// (filtered) records.
+// movieFilterClause is the WHERE clause used to filter movies by title and genres in
+// GetAll(), with the title in $1 and the genres in $2.
+const movieFilterClause = `(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')`
+
+// Update the function signature to return a Metadata struct. The fields parameter
+// limits the columns which are read for each movie.
+func (m MovieModel) GetAll(title string, genres []string, filters Filters, fields FieldSet) ([]*Movie, Metadata, error) {
+	// How we work out the pagination metadata depends on the total mode. For exact
+	// totals, we include the window function which counts the total (filtered)
+	// records in the query. This means that PostgreSQL has to visit every matching row,
+	// so for the other modes we leave it out. Instead, we either ask the planner for an
+	// estimate of the total, or we fetch one extra record so that we can tell whether
+	// there is a next page.
+	columns := fields.columns()
+	selectList := strings.Join(columns, ", ")
+	limit := filters.limit()
+	switch filters.totalMode() {
+	case TotalExact:
+		selectList = "count(*) OVER(), " + selectList
+	case TotalNone:
+		limit++
+	}
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version 
+		SELECT %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		WHERE %s
+		ORDER BY %s
+		LIMIT $3 OFFSET $4`, selectList, movieFilterClause, filters.orderBy())
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -214,9 +280,9 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), limit, filters.offset()}
 	// And then pass the args slice to QueryContext() as a variadic parameter.
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), args...)
 	if err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 	}
@@ -233,16 +299,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		var movie Movie
 		// Scan the values from the row into the Movie struct. Again, note that we're
 		// using the pq.Array() adapter on the genres field here.
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		var dest []any
+		if filters.totalMode() == TotalExact {
+			dest = append(dest, &totalRecords) // Scan the count from the window function into totalRecords.
+		}
+		for _, column := range columns {
+			dest = append(dest, movie.scanDest(column))
+		}
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 		}
@@ -255,9 +319,228 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 	}
+
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	var metadata Metadata
+	switch filters.totalMode() {
+	case TotalNone:
+		// If we got the extra record back then there is a next page. Trim it off before
+		// returning the movies.
+		hasNext := len(movies) > filters.limit()
+		if hasNext {
+			movies = movies[:filters.limit()]
+		}
+		metadata = calculateMetadataWithoutTotal(hasNext, filters)
+	case TotalEstimate:
+		totalRecords, err = m.estimateCount(ctx, movieFilterClause, title, pq.Array(genres))
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		metadata = calculateMetadata(totalRecords, filters)
+	case TotalExact:
+		metadata = calculateMetadata(totalRecords, filters)
+	}
 	// Include the metadata struct when returning.
 	return movies, metadata, nil
 }
+
+// The estimateCount() method returns the query planner's estimate of the number of
+// movies matching the given WHERE clause, taken from the output of EXPLAIN. This only
+// uses the table statistics, so it's very cheap, but it can be some way off if the
+// statistics are stale or the filter is unusual.
+func (m MovieModel) estimateCount(ctx context.Context, where string, args ...any) (int, error) {
+	query := fmt.Sprintf(`EXPLAIN (FORMAT JSON) SELECT id FROM movies WHERE %s`, where)
+
+	var plan []byte
+	err := m.DB.QueryRowContext(ctx, m.annotate(query), args...).Scan(&plan)
+	if err != nil {
+		return 0, err
+	}
+
+	var explain []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	err = json.Unmarshal(plan, &explain)
+	if err != nil {
+		return 0, err
+	}
+	if len(explain) == 0 {
+		return 0, errors.New("empty EXPLAIN output")
+	}
+	return int(explain[0].Plan.Rows), nil
+}
+
+// MovieSuggestion is the trimmed-down representation of a movie that we return from
+// the typeahead endpoint. It only carries the fields that a search box needs to render
+// a completion, which keeps the response body (and the query behind it) small.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// The Suggest() method returns up to limit movies whose title starts with the given
+// prefix (case-insensitively), with the most popular movies (the ones which have been
+// viewed the most, see IncrementPopularity()) first. The query is deliberately simple
+// so that it can be answered from the movies_title_prefix_popularity_idx index
+// without touching the count(*) OVER() machinery used by GetAll().
+func (m MovieModel) Suggest(prefix string, limit int) ([]*MovieSuggestion, error) {
+	query := `
+	SELECT id, title, year
+	FROM movies
+	WHERE lower(title) LIKE $1
+	ORDER BY popularity DESC, title ASC, id ASC
+	LIMIT $2`
+
+	// Escape any LIKE wildcard characters in the client-provided prefix, so that they
+	// are matched literally, and then append the % wildcard to make it a prefix match.
+	pattern := likeEscaper.Replace(strings.ToLower(prefix)) + "%"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*MovieSuggestion{}
+	for rows.Next() {
+		var suggestion MovieSuggestion
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// likeEscaper escapes the characters which have a special meaning in a LIKE pattern
+// (using PostgreSQL's default backslash escape character).
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func ValidateSuggestion(v *validator.Validator, prefix string, limit int) {
+	v.Check(strings.TrimSpace(prefix) != "", "q", "must be provided")
+	v.Check(len(prefix) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+}
+
+// The GetSimilarCandidates() method returns the movies which could be recommended as
+// similar to the given one: every other movie sharing at least one of its genres (which
+// is answered by the movies_genres_idx index), capped at limit records. Scoring and
+// ranking the candidates is left to the caller.
+//
+// So that the cap drops the least promising candidates, rather than whichever happen
+// to have the highest IDs, the candidates are roughly pre-ranked before the LIMIT: by
+// the number of genres they share with the movie (most first), then by how far apart
+// their release years are (closest first), with the ID to break any remaining ties.
+func (m MovieModel) GetSimilarCandidates(movie *Movie, limit int) ([]*Movie, error) {
+	query := `
+	SELECT id, created_at, updated_at, title, year, runtime, genres, version
+	FROM movies
+	WHERE id <> $1 AND genres && $2
+	ORDER BY (SELECT count(*) FROM unnest(genres) AS genre WHERE genre = ANY($2)) DESC,
+		abs(year - $3) ASC, id ASC
+	LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), movie.ID, pq.Array(movie.Genres), movie.Year, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+// The GetSimilarCandidatesForMany() method works in the same way as
+// GetSimilarCandidates(), but for several movies (given by ID) at once, and returns the
+// candidates keyed by the ID of the movie that they are candidates for, pre-ranked in
+// the same way. As with GetForGenres(), a lateral join runs the candidate query for
+// each of the movies, so that there is only one round trip to the database however
+// many movies there are.
+func (m MovieModel) GetSimilarCandidatesForMany(ids []int64, limit int) (map[int64][]*Movie, error) {
+	query := `
+	SELECT t.id, c.id, c.created_at, c.updated_at, c.title, c.year, c.runtime, c.genres, c.version
+	FROM movies AS t
+	CROSS JOIN LATERAL (
+		SELECT id, created_at, updated_at, title, year, runtime, genres, version
+		FROM movies
+		WHERE id <> t.id AND genres && t.genres
+		ORDER BY (SELECT count(*) FROM unnest(genres) AS genre WHERE genre = ANY(t.genres)) DESC,
+			abs(year - t.year) ASC, id ASC
+		LIMIT $2
+	) AS c
+	WHERE t.id = ANY($1)
+	ORDER BY t.id, c.id`
+
+	candidates := make(map[int64][]*Movie, len(ids))
+	for _, id := range ids {
+		candidates[id] = []*Movie{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.annotate(query), pq.Array(ids), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var movie Movie
+		err := rows.Scan(
+			&id,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		candidates[id] = append(candidates[id], &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
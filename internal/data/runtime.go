@@ -3,6 +3,8 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -64,3 +66,33 @@ func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 	*r = Runtime(i)
 	return nil
 }
+
+// isoRuntimeRX matches the ISO 8601 durations that we accept for a runtime, like
+// "PT1H42M" or "P1DT2H". Only days, hours, minutes and seconds are allowed, as months
+// and years don't have a fixed length.
+var isoRuntimeRX = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// ParseISORuntime converts an ISO 8601 duration, like "PT1H42M", into a Runtime. The
+// duration must be a whole number of minutes, and it returns ErrInvalidRuntimeFormat if
+// it isn't or if the string isn't a duration at all.
+func ParseISORuntime(s string) (Runtime, error) {
+	matches := isoRuntimeRX.FindStringSubmatch(s)
+	if matches == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, ErrInvalidRuntimeFormat
+	}
+	var seconds int64
+	for i, unit := range []int64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(matches[i+1], 10, 32)
+		if err != nil {
+			return 0, ErrInvalidRuntimeFormat
+		}
+		seconds += n * unit
+	}
+	if seconds%60 != 0 || seconds/60 > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+	return Runtime(seconds / 60), nil
+}
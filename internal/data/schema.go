@@ -0,0 +1,35 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SchemaVersion is the version of the newest migration in the migrations directory,
+// which is the database schema version that this code expects. It must be bumped
+// whenever a new migration is added.
+const SchemaVersion = 10
+
+// Define a SchemaModel struct type which wraps a sql.DB connection pool, and is used
+// to check the state of the database schema.
+type SchemaModel struct {
+	DB *sql.DB
+}
+
+// The Version() method returns the version of the last migration applied to the
+// database, and whether it's dirty (that is, whether the migration failed part way
+// through), from the schema_migrations table maintained by the migrate tool.
+func (m SchemaModel) Version(ctx context.Context) (int64, bool, error) {
+	query := `
+	SELECT version, dirty
+	FROM schema_migrations
+	LIMIT 1`
+
+	var version int64
+	var dirty bool
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, dirty, nil
+}
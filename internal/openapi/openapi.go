@@ -0,0 +1,402 @@
+// Package openapi checks HTTP requests and responses against an OpenAPI 3.1 document.
+// It supports the parts of OpenAPI and JSON Schema that our API document uses: path,
+// query and header parameters, JSON request and response bodies, local $refs, and the
+// common validation keywords (type, enum, const, properties, required,
+// additionalProperties, items, the numeric, string and array limits, pattern, allOf,
+// anyOf and oneOf). Other keywords, like format, are treated as annotations and ignored.
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is a parsed OpenAPI document.
+type Document struct {
+	root       map[string]any
+	operations []*Operation
+}
+
+// Operation is one of the operations in a document, identified by its method and path
+// template (like "GET /v1/movies/{id}").
+type Operation struct {
+	Method string
+	Path   string
+
+	doc      *Document
+	segments []string
+	spec     map[string]any
+	params   []map[string]any
+}
+
+// Parse parses an OpenAPI document in JSON format.
+func Parse(js []byte) (*Document, error) {
+	var root map[string]any
+	err := json.Unmarshal(js, &root)
+	if err != nil {
+		return nil, err
+	}
+	version, _ := root["openapi"].(string)
+	if !strings.HasPrefix(version, "3.1.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", version)
+	}
+
+	doc := &Document{root: root}
+	paths, _ := root["paths"].(map[string]any)
+	for path, item := range paths {
+		item, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("path %s: not an object", path)
+		}
+		shared, err := doc.parameters(item["parameters"])
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %w", path, err)
+		}
+		for _, method := range []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"} {
+			spec, ok := item[method].(map[string]any)
+			if !ok {
+				continue
+			}
+			params, err := doc.parameters(spec["parameters"])
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path, err)
+			}
+			doc.operations = append(doc.operations, &Operation{
+				Method:   strings.ToUpper(method),
+				Path:     path,
+				doc:      doc,
+				segments: strings.Split(strings.Trim(path, "/"), "/"),
+				spec:     spec,
+				params:   append(params, shared...),
+			})
+		}
+	}
+
+	// Sort the operations so that paths with literal segments are matched before paths
+	// with a template expression in the same place (so that /v1/movies/suggest is
+	// matched before /v1/movies/{id}).
+	sort.Slice(doc.operations, func(i, j int) bool {
+		a, b := doc.operations[i], doc.operations[j]
+		for k := 0; k < len(a.segments) && k < len(b.segments); k++ {
+			aParam, bParam := isTemplate(a.segments[k]), isTemplate(b.segments[k])
+			if aParam != bParam {
+				return bParam
+			}
+			if a.segments[k] != b.segments[k] {
+				return a.segments[k] < b.segments[k]
+			}
+		}
+		if len(a.segments) != len(b.segments) {
+			return len(a.segments) < len(b.segments)
+		}
+		return a.Method < b.Method
+	})
+	return doc, nil
+}
+
+// Operations returns every operation in the document.
+func (d *Document) Operations() []*Operation {
+	return d.operations
+}
+
+// Find returns the operation for a request method and path, along with the values of
+// the path parameters. It returns a nil operation if there isn't one.
+func (d *Document) Find(method, path string) (*Operation, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, op := range d.operations {
+		if op.Method != method || len(op.segments) != len(segments) {
+			continue
+		}
+		values := make(map[string]string)
+		matched := true
+		for i, segment := range op.segments {
+			if isTemplate(segment) {
+				value, err := url.PathUnescape(segments[i])
+				if err != nil {
+					matched = false
+					break
+				}
+				values[strings.Trim(segment, "{}")] = value
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return op, values
+		}
+	}
+	return nil, nil
+}
+
+// The parameters() method resolves a list of parameter objects.
+func (d *Document) parameters(list any) ([]map[string]any, error) {
+	items, _ := list.([]any)
+	params := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		param, err := d.resolve(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := param["name"].(string); !ok {
+			return nil, errors.New("parameter without a name")
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+// The resolve() method follows a $ref to another object in the document (if the value
+// is a reference), and returns the object.
+func (d *Document) resolve(value any) (map[string]any, error) {
+	for range 32 {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("expected an object, got %T", value)
+		}
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj, nil
+		}
+		value, ok = d.pointer(ref)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+	return nil, errors.New("too many levels of references")
+}
+
+// The pointer() method looks up a local reference, like "#/components/schemas/Movie".
+func (d *Document) pointer(ref string) (any, bool) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var value any = d.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		value, ok = obj[token]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// PathErrors checks the path parameters of a request against the operation, and
+// returns any problems keyed by parameter name.
+func (o *Operation) PathErrors(values map[string]string) map[string]string {
+	errs := make(map[string]string)
+	for _, param := range o.params {
+		if param["in"] == "path" {
+			name := param["name"].(string)
+			o.checkParameter(param, []string{values[name]}, name, errs)
+		}
+	}
+	return errs
+}
+
+// RequestErrors checks the query string, headers and body of a request against the
+// operation, and returns any problems keyed by parameter name or top-level body field.
+// The body is the decoded JSON request body, or nil if there isn't one.
+func (o *Operation) RequestErrors(r *http.Request, body any) map[string]string {
+	errs := make(map[string]string)
+	qs := r.URL.Query()
+	for _, param := range o.params {
+		name := param["name"].(string)
+		switch param["in"] {
+		case "query":
+			if qs.Has(name) {
+				o.checkParameter(param, qs[name], name, errs)
+			} else if param["required"] == true {
+				errs[name] = "must be provided"
+			}
+		case "header":
+			if values := r.Header.Values(name); len(values) > 0 {
+				o.checkParameter(param, values, name, errs)
+			} else if param["required"] == true {
+				errs[name] = "must be provided"
+			}
+		}
+	}
+
+	requestBody, ok := o.spec["requestBody"]
+	if !ok || body == nil {
+		return errs
+	}
+	rb, err := o.doc.resolve(requestBody)
+	if err != nil {
+		errs["body"] = err.Error()
+		return errs
+	}
+	schema, ok := mediaSchema(rb, "application/json")
+	if !ok {
+		return errs
+	}
+	for _, problem := range o.doc.validate(schema, body, "") {
+		key, detail := problem.field()
+		if _, exists := errs[key]; !exists {
+			errs[key] = detail
+		}
+	}
+	return errs
+}
+
+// ResponseErrors checks a response against the operation, and returns a description of
+// each problem. Only the status code and JSON bodies are checked.
+func (o *Operation) ResponseErrors(status int, contentType string, body []byte) []string {
+	responses, _ := o.spec["responses"].(map[string]any)
+	response, ok := responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = responses[strconv.Itoa(status/100)+"XX"]
+	}
+	if !ok {
+		response, ok = responses["default"]
+	}
+	if !ok {
+		return []string{fmt.Sprintf("status %d is not documented", status)}
+	}
+	resp, err := o.doc.resolve(response)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+	schema, ok := mediaSchema(resp, mediaType)
+	if !ok {
+		if content, _ := resp["content"].(map[string]any); len(content) > 0 {
+			return []string{fmt.Sprintf("content type %q is not documented for status %d", mediaType, status)}
+		}
+		return nil
+	}
+
+	var value any
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		return []string{"body is not valid JSON: " + err.Error()}
+	}
+	var messages []string
+	for _, problem := range o.doc.validate(schema, value, "") {
+		messages = append(messages, problem.String())
+	}
+	return messages
+}
+
+// The checkParameter() method converts the raw values of a parameter to the type in its
+// schema and validates them, adding any problem to errs. Array parameters use the
+// default form style without explode, which is a single comma-separated value.
+func (o *Operation) checkParameter(param map[string]any, raw []string, name string, errs map[string]string) {
+	schema, ok := param["schema"]
+	if !ok {
+		return
+	}
+	s, err := o.doc.resolve(schema)
+	if err != nil {
+		errs[name] = err.Error()
+		return
+	}
+
+	var value any
+	if hasType(s, "array") {
+		items, _ := s["items"].(map[string]any)
+		list := []any{}
+		for _, part := range strings.Split(strings.Join(raw, ","), ",") {
+			if part == "" {
+				continue
+			}
+			item, msg := convertParameter(o.doc, items, part)
+			if msg != "" {
+				errs[name] = msg
+				return
+			}
+			list = append(list, item)
+		}
+		value = list
+	} else {
+		var msg string
+		value, msg = convertParameter(o.doc, s, raw[0])
+		if msg != "" {
+			errs[name] = msg
+			return
+		}
+	}
+
+	if problems := o.doc.validate(s, value, ""); len(problems) > 0 {
+		errs[name] = problems[0].message
+	}
+}
+
+// convertParameter converts a parameter value from a string to the type in its schema.
+// It returns a message describing the problem if it can't.
+func convertParameter(doc *Document, schema map[string]any, raw string) (any, string) {
+	if schema != nil {
+		if resolved, err := doc.resolve(schema); err == nil {
+			schema = resolved
+		}
+	}
+	switch {
+	case hasType(schema, "integer"):
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, "must be an integer value"
+		}
+		return float64(n), ""
+	case hasType(schema, "number"):
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, "must be a number"
+		}
+		return f, ""
+	case hasType(schema, "boolean"):
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, "must be a boolean value"
+		}
+		return b, ""
+	default:
+		return raw, ""
+	}
+}
+
+// mediaSchema returns the schema for a media type in a request body or response object.
+func mediaSchema(obj map[string]any, mediaType string) (any, bool) {
+	content, _ := obj["content"].(map[string]any)
+	media, ok := content[mediaType].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	schema, ok := media["schema"]
+	return schema, ok
+}
+
+// hasType reports whether a schema's type keyword includes the given type.
+func hasType(schema map[string]any, typ string) bool {
+	switch t := schema["type"].(type) {
+	case string:
+		return t == typ
+	case []any:
+		for _, item := range t {
+			if item == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTemplate(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
@@ -0,0 +1,306 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// problem describes a value which doesn't match its schema. The path is a slash
+// separated list of the object keys and array indexes leading to the value, like
+// "genres/2", or empty for the whole value.
+type problem struct {
+	path    string
+	message string
+}
+
+// The field() method splits the problem into the top-level field that it relates to,
+// and a message which includes the rest of the path (if there is any).
+func (p problem) field() (string, string) {
+	if p.path == "" {
+		return "body", p.message
+	}
+	field, rest, found := strings.Cut(p.path, "/")
+	if !found {
+		return field, p.message
+	}
+	return field, rest + ": " + p.message
+}
+
+func (p problem) String() string {
+	if p.path == "" {
+		return p.message
+	}
+	return p.path + ": " + p.message
+}
+
+// patterns caches the compiled regular expressions for pattern keywords.
+var patterns sync.Map
+
+// The validate() method checks a decoded JSON value against a schema, and returns any
+// problems with it.
+func (d *Document) validate(schema any, value any, path string) []problem {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			return []problem{{path, "is not allowed"}}
+		}
+		return nil
+	case map[string]any:
+		return d.validateObject(s, value, path)
+	default:
+		return []problem{{path, fmt.Sprintf("invalid schema of type %T", schema)}}
+	}
+}
+
+func (d *Document) validateObject(s map[string]any, value any, path string) []problem {
+	var problems []problem
+	add := func(message string, args ...any) {
+		problems = append(problems, problem{path, fmt.Sprintf(message, args...)})
+	}
+
+	// In OpenAPI 3.1, a $ref can have sibling keywords, so the referenced schema is
+	// applied in addition to the rest of this one.
+	if ref, ok := s["$ref"].(string); ok {
+		target, found := d.pointer(ref)
+		if !found {
+			add("unresolvable reference %q", ref)
+			return problems
+		}
+		problems = append(problems, d.validate(target, value, path)...)
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		add("must be %s", describeType(t))
+		return problems
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(enum))
+			for i, allowed := range enum {
+				js, _ := json.Marshal(allowed)
+				names[i] = string(js)
+			}
+			add("must be one of %s", strings.Join(names, ", "))
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		js, _ := json.Marshal(c)
+		add("must be %s", js)
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if limit, ok := s["minimum"].(float64); ok && v < limit {
+			add("must be at least %v", limit)
+		}
+		if limit, ok := s["maximum"].(float64); ok && v > limit {
+			add("must be at most %v", limit)
+		}
+		if limit, ok := s["exclusiveMinimum"].(float64); ok && v <= limit {
+			add("must be greater than %v", limit)
+		}
+		if limit, ok := s["exclusiveMaximum"].(float64); ok && v >= limit {
+			add("must be less than %v", limit)
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if limit, ok := s["minLength"].(float64); ok && length < limit {
+			add("must be at least %v characters long", limit)
+		}
+		if limit, ok := s["maxLength"].(float64); ok && length > limit {
+			add("must not be more than %v characters long", limit)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			rx, err := compilePattern(pattern)
+			if err != nil {
+				add("invalid pattern %q in schema", pattern)
+			} else if !rx.MatchString(v) {
+				add("must match the pattern %s", pattern)
+			}
+		}
+
+	case []any:
+		if limit, ok := s["minItems"].(float64); ok && float64(len(v)) < limit {
+			add("must contain at least %v items", limit)
+		}
+		if limit, ok := s["maxItems"].(float64); ok && float64(len(v)) > limit {
+			add("must not contain more than %v items", limit)
+		}
+		if s["uniqueItems"] == true && hasDuplicates(v) {
+			add("must not contain duplicate values")
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				problems = append(problems, d.validate(items, item, join(path, fmt.Sprint(i)))...)
+			}
+		}
+
+	case map[string]any:
+		if required, ok := s["required"].([]any); ok {
+			for _, name := range required {
+				name, _ := name.(string)
+				if _, found := v[name]; !found {
+					problems = append(problems, problem{join(path, name), "must be provided"})
+				}
+			}
+		}
+		if limit, ok := s["minProperties"].(float64); ok && float64(len(v)) < limit {
+			add("must contain at least %v fields", limit)
+		}
+
+		properties, _ := s["properties"].(map[string]any)
+		additional, hasAdditional := s["additionalProperties"]
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := properties[key]; ok {
+				problems = append(problems, d.validate(property, v[key], join(path, key))...)
+			} else if hasAdditional {
+				if additional == false {
+					problems = append(problems, problem{join(path, key), "unknown field"})
+				} else {
+					problems = append(problems, d.validate(additional, v[key], join(path, key))...)
+				}
+			}
+		}
+	}
+
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			problems = append(problems, d.validate(sub, value, path)...)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(d.validate(sub, value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			add("must match at least one of the allowed schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if len(d.validate(sub, value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			add("must match exactly one of the allowed schemas")
+		}
+	}
+
+	return problems
+}
+
+// matchesType reports whether a decoded JSON value has one of the types listed in a
+// type keyword.
+func matchesType(t any, value any) bool {
+	types, ok := t.([]any)
+	if !ok {
+		types = []any{t}
+	}
+	for _, typ := range types {
+		switch v := value.(type) {
+		case nil:
+			if typ == "null" {
+				return true
+			}
+		case bool:
+			if typ == "boolean" {
+				return true
+			}
+		case float64:
+			if typ == "number" || (typ == "integer" && v == float64(int64(v))) {
+				return true
+			}
+		case string:
+			if typ == "string" {
+				return true
+			}
+		case []any:
+			if typ == "array" {
+				return true
+			}
+		case map[string]any:
+			if typ == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// describeType returns a description of the types in a type keyword, like "a string"
+// or "an integer or null".
+func describeType(t any) string {
+	types, ok := t.([]any)
+	if !ok {
+		types = []any{t}
+	}
+	names := make([]string, len(types))
+	for i, typ := range types {
+		switch typ {
+		case "integer", "array", "object":
+			names[i] = fmt.Sprintf("an %s", typ)
+		case "null":
+			names[i] = "null"
+		default:
+			names[i] = fmt.Sprintf("a %s", typ)
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// hasDuplicates reports whether any two items in a list are equal.
+func hasDuplicates(list []any) bool {
+	for i := range list {
+		for j := i + 1; j < len(list); j++ {
+			if reflect.DeepEqual(list[i], list[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if rx, ok := patterns.Load(pattern); ok {
+		return rx.(*regexp.Regexp), nil
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, rx)
+	return rx, nil
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "/" + key
+}
@@ -0,0 +1,124 @@
+package recommender
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"math"
+	"sort"
+)
+
+// Scorer is implemented by any similarity strategy. Score() should return a value
+// between 0 (nothing in common) and 1 (identical) describing how similar the candidate
+// movie is to the target movie. Keeping this as an interface means that handlers don't
+// care which strategy they have been given, and a different one can be swapped in
+// without touching them.
+type Scorer interface {
+	Score(target, candidate *data.Movie) float64
+}
+
+// Weights holds the relative importance of each signal used by the WeightedScorer.
+// The weights don't need to add up to 1, as the final score is normalized by their
+// total.
+type Weights struct {
+	Genres  float64
+	Year    float64
+	Runtime float64
+}
+
+// WeightedScorer combines genre-set overlap, release year proximity and runtime
+// proximity into a single weighted score. YearScale and RuntimeScale control how
+// quickly the proximity signals fall away: a difference of exactly YearScale years (or
+// RuntimeScale minutes) scores 0.5 for that signal.
+type WeightedScorer struct {
+	Weights      Weights
+	YearScale    float64
+	RuntimeScale float64
+}
+
+// NewWeightedScorer returns a WeightedScorer using the given weights and sensible
+// default scales of 10 years and 30 minutes.
+func NewWeightedScorer(weights Weights) WeightedScorer {
+	return WeightedScorer{
+		Weights:      weights,
+		YearScale:    10,
+		RuntimeScale: 30,
+	}
+}
+
+// Score implements the Scorer interface.
+func (s WeightedScorer) Score(target, candidate *data.Movie) float64 {
+	total := s.Weights.Genres + s.Weights.Year + s.Weights.Runtime
+	if total <= 0 {
+		return 0
+	}
+	score := s.Weights.Genres*Jaccard(target.Genres, candidate.Genres) +
+		s.Weights.Year*proximity(float64(target.Year-candidate.Year), s.YearScale) +
+		s.Weights.Runtime*proximity(float64(target.Runtime-candidate.Runtime), s.RuntimeScale)
+	return score / total
+}
+
+// Jaccard returns the Jaccard index of two sets of strings: the size of their
+// intersection divided by the size of their union. Two empty sets are considered to
+// have nothing in common.
+func Jaccard(a, b []string) float64 {
+	set := make(map[string]bool, len(a))
+	for _, value := range a {
+		set[value] = true
+	}
+	union := len(set)
+	intersection := 0
+	seen := make(map[string]bool, len(b))
+	for _, value := range b {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		if set[value] {
+			intersection++
+		} else {
+			union++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(union)
+}
+
+// proximity converts an absolute difference into a score between 0 and 1, where a
+// difference of zero scores 1 and the score halves once the difference reaches scale.
+func proximity(diff, scale float64) float64 {
+	if scale <= 0 {
+		if diff == 0 {
+			return 1
+		}
+		return 0
+	}
+	return 1 / (1 + math.Abs(diff)/scale)
+}
+
+// Result is a candidate movie along with its similarity score.
+type Result struct {
+	Score float64     `json:"score"`
+	Movie *data.Movie `json:"movie"`
+}
+
+// Rank scores every candidate against the target movie using the given Scorer, and
+// returns the results ordered from most to least similar. Ties are broken by movie ID
+// so that the ordering is stable between requests, which matters for pagination. The
+// target movie itself is never included in the results.
+func Rank(s Scorer, target *data.Movie, candidates []*data.Movie) []Result {
+	results := make([]Result, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.ID == target.ID {
+			continue
+		}
+		results = append(results, Result{Score: s.Score(target, candidate), Movie: candidate})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Movie.ID < results[j].Movie.ID
+	})
+	return results
+}
@@ -0,0 +1,136 @@
+package recommender
+
+import (
+	"GoFurtherWebPractice/internal/data"
+	"math"
+	"testing"
+)
+
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want float64
+	}{
+		{"identical", []string{"drama", "comedy"}, []string{"comedy", "drama"}, 1},
+		{"disjoint", []string{"drama"}, []string{"comedy"}, 0},
+		{"overlap", []string{"drama", "comedy"}, []string{"comedy", "action"}, 1.0 / 3},
+		{"subset", []string{"drama", "comedy", "action", "horror"}, []string{"drama"}, 0.25},
+		{"duplicates", []string{"drama", "drama"}, []string{"drama", "drama", "comedy"}, 0.5},
+		{"one empty", []string{"drama"}, nil, 0},
+		{"both empty", nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Jaccard(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Jaccard(%q, %q) = %v; want %v", tt.a, tt.b, got, tt.want)
+			}
+			if reversed := Jaccard(tt.b, tt.a); math.Abs(reversed-got) > 1e-9 {
+				t.Errorf("Jaccard(%q, %q) = %v; want %v (the same in both directions)", tt.b, tt.a, reversed, got)
+			}
+		})
+	}
+}
+
+func TestWeightedScorer(t *testing.T) {
+	target := &data.Movie{ID: 1, Year: 2000, Runtime: 100, Genres: []string{"drama", "comedy"}}
+
+	tests := []struct {
+		name      string
+		weights   Weights
+		candidate *data.Movie
+		want      float64
+	}{
+		{
+			name:      "identical",
+			weights:   Weights{Genres: 0.6, Year: 0.2, Runtime: 0.2},
+			candidate: &data.Movie{ID: 2, Year: 2000, Runtime: 100, Genres: []string{"comedy", "drama"}},
+			want:      1,
+		},
+		{
+			name:      "one scale away",
+			weights:   Weights{Genres: 0, Year: 1, Runtime: 1},
+			candidate: &data.Movie{ID: 2, Year: 2010, Runtime: 70, Genres: []string{"drama"}},
+			want:      0.5,
+		},
+		{
+			name:      "genres only",
+			weights:   Weights{Genres: 1},
+			candidate: &data.Movie{ID: 2, Year: 1950, Runtime: 200, Genres: []string{"drama"}},
+			want:      0.5,
+		},
+		{
+			name:      "weights normalized",
+			weights:   Weights{Genres: 3, Year: 1},
+			candidate: &data.Movie{ID: 2, Year: 2000, Runtime: 100, Genres: []string{"horror"}},
+			want:      0.25,
+		},
+		{
+			name:      "no weights",
+			weights:   Weights{},
+			candidate: &data.Movie{ID: 2, Year: 2000, Runtime: 100, Genres: []string{"drama", "comedy"}},
+			want:      0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewWeightedScorer(tt.weights).Score(target, tt.candidate)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Score() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedScorerZeroScale(t *testing.T) {
+	s := WeightedScorer{Weights: Weights{Year: 1}}
+	target := &data.Movie{ID: 1, Year: 2000}
+
+	if got := s.Score(target, &data.Movie{ID: 2, Year: 2000}); got != 1 {
+		t.Errorf("Score() for the same year = %v; want 1", got)
+	}
+	if got := s.Score(target, &data.Movie{ID: 2, Year: 2001}); got != 0 {
+		t.Errorf("Score() for a different year = %v; want 0", got)
+	}
+}
+
+// scoreByID is a Scorer which returns a fixed score for each candidate ID, so that the
+// ordering of Rank() can be tested independently of any real scoring strategy.
+type scoreByID map[int64]float64
+
+func (s scoreByID) Score(target, candidate *data.Movie) float64 {
+	return s[candidate.ID]
+}
+
+func TestRank(t *testing.T) {
+	target := &data.Movie{ID: 1}
+	candidates := []*data.Movie{{ID: 5}, {ID: 1}, {ID: 3}, {ID: 4}, {ID: 2}}
+	scorer := scoreByID{1: 1, 2: 0.2, 3: 0.9, 4: 0.5, 5: 0.5}
+
+	results := Rank(scorer, target, candidates)
+
+	// The target is dropped, the rest are ordered by score, and the tie between movies
+	// 4 and 5 is broken by ID, whatever order they came in.
+	wantIDs := []int64{3, 4, 5, 2}
+	if len(results) != len(wantIDs) {
+		t.Fatalf("got %d results; want %d", len(results), len(wantIDs))
+	}
+	for i, id := range wantIDs {
+		if results[i].Movie.ID != id {
+			t.Errorf("results[%d].Movie.ID = %d; want %d", i, results[i].Movie.ID, id)
+		}
+		if results[i].Score != scorer[id] {
+			t.Errorf("results[%d].Score = %v; want %v", i, results[i].Score, scorer[id])
+		}
+	}
+}
+
+func TestRankEmpty(t *testing.T) {
+	results := Rank(scoreByID{}, &data.Movie{ID: 1}, nil)
+	if results == nil || len(results) != 0 {
+		t.Errorf("Rank() = %#v; want an empty, non-nil slice", results)
+	}
+}
@@ -9,6 +9,9 @@ import (
 // note further down the page.
 var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\. [a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	// RequestIDRX matches the request IDs that we accept from clients: between 1 and
+	// 128 letters, digits, dots, underscores and hyphens.
+	RequestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
 )
 
 // Define a new Validator type which contains a map of validation errors.
@@ -0,0 +1,2 @@
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS popularity INTEGER NOT NULL DEFAULT 0;
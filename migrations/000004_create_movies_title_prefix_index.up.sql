@@ -0,0 +1,3 @@
+-- The text_pattern_ops operator class lets PostgreSQL use this index for
+-- left-anchored LIKE queries regardless of the database collation.
+CREATE INDEX IF NOT EXISTS movies_title_prefix_idx ON movies (lower(title) text_pattern_ops);
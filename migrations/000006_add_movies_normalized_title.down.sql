@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS movies_normalized_title_trgm_idx;
+DROP INDEX IF EXISTS movies_normalized_title_year_idx;
+
+ALTER TABLE movies
+	DROP COLUMN IF EXISTS normalized_title;
+
+DROP FUNCTION IF EXISTS movies_normalize_title(TEXT);
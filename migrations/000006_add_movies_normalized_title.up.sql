@@ -0,0 +1,15 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Normalize a title for duplicate detection: lower-case it, collapse every run of
+-- punctuation and whitespace into a single space, and trim the ends. So "Black Panther"
+-- and "black-panther!" both become "black panther".
+CREATE OR REPLACE FUNCTION movies_normalize_title(title TEXT) RETURNS TEXT AS $$
+	SELECT btrim(regexp_replace(lower(title), '[^[:alnum:]]+', ' ', 'g'))
+$$ LANGUAGE SQL IMMUTABLE STRICT PARALLEL SAFE;
+
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS normalized_title TEXT
+		GENERATED ALWAYS AS (movies_normalize_title(title)) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_normalized_title_year_idx ON movies (normalized_title, year);
+CREATE INDEX IF NOT EXISTS movies_normalized_title_trgm_idx ON movies USING GIN (normalized_title gin_trgm_ops);
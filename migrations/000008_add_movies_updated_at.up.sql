@@ -0,0 +1,6 @@
+ALTER TABLE movies
+	ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+-- Existing movies haven't been updated since we started tracking it, so the best we
+-- can say is that they were last updated when they were created.
+UPDATE movies SET updated_at = created_at;
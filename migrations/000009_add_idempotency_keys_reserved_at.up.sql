@@ -0,0 +1,2 @@
+ALTER TABLE idempotency_keys
+	ADD COLUMN IF NOT EXISTS reserved_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
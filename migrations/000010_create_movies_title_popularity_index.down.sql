@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS movies_title_prefix_idx ON movies (lower(title) text_pattern_ops);
+DROP INDEX IF EXISTS movies_title_prefix_popularity_idx;
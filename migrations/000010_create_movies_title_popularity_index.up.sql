@@ -0,0 +1,5 @@
+-- Suggest() matches a title prefix and orders the matches by popularity, so include
+-- the popularity in the prefix index. This replaces movies_title_prefix_idx, which the
+-- new index covers for prefix matches on its own.
+CREATE INDEX IF NOT EXISTS movies_title_prefix_popularity_idx ON movies (lower(title) text_pattern_ops, popularity DESC);
+DROP INDEX IF EXISTS movies_title_prefix_idx;